@@ -2,35 +2,65 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
+
+	"core/internal/aaguid"
+	"core/internal/config"
 	"core/internal/database"
+	"core/internal/models"
 	"core/internal/server"
 )
 
-func init() {
-	db := database.New()
+func main() {
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		runMigrate(cfg, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "credential" {
+		runCredential(cfg, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "user" {
+		runUser(cfg, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "audit" {
+		runAudit(cfg, args[1:])
+		return
+	}
+
+	db := database.New(cfg.Database)
 	// defer db.Close()
 
-	err := db.CreateTables(context.Background())
+	err = db.Migrate(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func main() {
-	server := server.NewServer()
+	server := server.NewServer(cfg)
 
 	done := make(chan bool, 1)
 
-	go gracefulShutdown(server, done)
+	go gracefulShutdown(server, cfg.Server.ShutdownTimeout, done)
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		panic(fmt.Sprintf("http server error: %s", err))
 	}
@@ -39,7 +69,210 @@ func main() {
 	log.Println("Graceful shutdown complete.")
 }
 
-func gracefulShutdown(apiServer *http.Server, done chan bool) {
+// runMigrate implements the migrate subcommand, which follows any flags:
+//
+//	migrate [up]       apply every pending migration
+//	migrate down       revert the newest migration
+//	migrate to N       migrate up or down to version N
+//	migrate status     list migrations and when they were applied
+func runMigrate(cfg *config.Config, args []string) {
+	ctx := context.Background()
+	db := database.New(cfg.Database)
+	defer db.Close()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	var err error
+	switch command {
+	case "up":
+		err = db.Migrate(ctx)
+	case "down":
+		var version int
+		version, err = db.SchemaVersion(ctx)
+		if err == nil && version > 0 {
+			err = db.MigrateTo(ctx, version-1)
+		}
+	case "to":
+		if len(args) < 2 {
+			log.Fatal("usage: migrate to <version>")
+		}
+		var version int
+		version, err = strconv.Atoi(args[1])
+		if err == nil {
+			err = db.MigrateTo(ctx, version)
+		}
+	case "status":
+		var status []database.MigrationStatus
+		status, err = db.MigrationStatus(ctx)
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s  %s\n", m.Version, m.Name, applied)
+		}
+	default:
+		log.Fatalf("unknown migrate command %q", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runCredential implements administrative credential commands:
+//
+//	credential reinstate ID   lift the clone warning and suspension of a credential
+func runCredential(cfg *config.Config, args []string) {
+	if len(args) != 2 || args[0] != "reinstate" {
+		log.Fatal("usage: credential reinstate <credential id>")
+	}
+
+	db := database.New(cfg.Database)
+	defer db.Close()
+
+	if err := db.ReinstateCredential(context.Background(), "", args[1]); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Reinstated credential %s", args[1])
+}
+
+// runUser implements administrative user commands:
+//
+//	user role NAME|ID admin|user   grant or take away the administrator role
+//
+// Granting the first administrator this way bootstraps the /admin API.
+func runUser(cfg *config.Config, args []string) {
+	if len(args) != 3 || args[0] != "role" || (args[2] != models.RoleAdmin && args[2] != "user") {
+		log.Fatal("usage: user role <name or id> admin|user")
+	}
+	role := args[2]
+	if role == "user" {
+		role = ""
+	}
+
+	ctx := context.Background()
+	db := database.New(cfg.Database)
+	defer db.Close()
+
+	user, err := db.GetUserByName(ctx, args[1])
+	if err == nil && user == nil {
+		user, err = db.GetUserByID(ctx, args[1])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if user == nil {
+		log.Fatalf("user %q not found", args[1])
+	}
+
+	if err := db.SetUserRole(ctx, user.ID, role); err != nil {
+		log.Fatal(err)
+	}
+	// Sessions cannot be rotated from here, so the user logs in again and
+	// gets fresh ones that carry the new role
+	if _, err := db.RevokeUserSessions(ctx, user.ID); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.RecordRoleChange(ctx, db, user.ID, args[2]); err != nil {
+		log.Printf("Failed to record audit event: %v", err)
+	}
+	log.Printf("Set role of user %s to %s", user.Name, args[2])
+}
+
+// runAudit implements the audit subcommand, which prints audit events newest
+// first as JSON lines:
+//
+//	audit [-user NAME|ID] [-type TYPE,...] [-since TIME] [-until TIME] [-limit N] [-cursor ID]
+//
+// Times are RFC 3339. When more events match than -limit, the ID to pass as
+// -cursor for the next page is logged.
+func runAudit(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	user := flags.String("user", "", "only events of this user, by name or ID")
+	types := flags.String("type", "", "only these comma-separated event types")
+	since := flags.String("since", "", "only events at or after this time")
+	until := flags.String("until", "", "only events before this time")
+	limit := flags.Int("limit", 100, "maximum number of events")
+	cursor := flags.String("cursor", "", "continue after this event ID")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	db := database.New(cfg.Database)
+	defer db.Close()
+
+	filter := database.AuditFilter{Cursor: *cursor, Limit: *limit + 1}
+	if *user != "" {
+		filter.UserID = *user
+		u, err := db.GetUserByName(ctx, *user)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if u != nil {
+			filter.UserID = u.ID
+		}
+	}
+	if *types != "" {
+		filter.Types = strings.Split(*types, ",")
+	}
+	for _, t := range []struct {
+		value string
+		into  *time.Time
+	}{{*since, &filter.Since}, {*until, &filter.Until}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			log.Fatalf("invalid time %q: %v", t.value, err)
+		}
+		*t.into = parsed
+	}
+
+	catalog, err := aaguid.Load(cfg.WebAuthn.AuthenticatorCatalog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	events, err := db.ListAuditEvents(ctx, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	more := len(events) > *limit
+	if more {
+		events = events[:*limit]
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	for _, e := range events {
+		var model, authenticator string
+		if id, err := uuid.FromBytes(e.AAGUID); err == nil {
+			model = id.String()
+		}
+		if a, ok := catalog.Lookup(e.AAGUID); ok {
+			authenticator = a.Name
+		}
+		out.Encode(struct {
+			ID            string         `json:"id"`
+			Time          time.Time      `json:"time"`
+			Type          string         `json:"type"`
+			UserID        string         `json:"userID,omitempty"`
+			CredentialID  string         `json:"credentialID,omitempty"`
+			AAGUID        string         `json:"aaguid,omitempty"`
+			Authenticator string         `json:"authenticator,omitempty"`
+			IP            string         `json:"ip,omitempty"`
+			UserAgent     string         `json:"userAgent,omitempty"`
+			Details       map[string]any `json:"details,omitempty"`
+		}{e.ID, e.CreatedAt, e.Type, e.UserID, e.CredentialID, model, authenticator, e.IP, e.UserAgent, e.Details})
+	}
+	if more {
+		log.Printf("More events match; continue with -cursor %s", events[len(events)-1].ID)
+	}
+}
+
+func gracefulShutdown(apiServer *http.Server, timeout time.Duration, done chan bool) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
@@ -47,7 +280,7 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 
 	log.Println("shutting down gracefully, press Ctrl+C again to force")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	if err := apiServer.Shutdown(ctx); err != nil {
 		log.Printf("Server forced to shutdown with error: %v", err)
@@ -0,0 +1,87 @@
+// Package aaguid names authenticator models by the AAGUID they report at
+// registration.
+//
+// catalog.json uses the schema of the community list at
+// https://github.com/passkeydeveloper/passkey-authenticator-aaguids, so it can
+// be refreshed by replacing it with that repository's aaguid.json, which is
+// what go generate (or make aaguids) does; the list's icons come with it. A
+// file in the same format can also be loaded at startup to add or override
+// entries without rebuilding.
+package aaguid
+
+//go:generate curl -fsSL -o catalog.json https://raw.githubusercontent.com/passkeydeveloper/passkey-authenticator-aaguids/main/aaguid.json
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/google/uuid"
+)
+
+//go:embed catalog.json
+var embedded []byte
+
+// Authenticator describes an authenticator model
+type Authenticator struct {
+	Name      string
+	IconLight string // data: URL for light backgrounds
+	IconDark  string // data: URL for dark backgrounds
+}
+
+// Catalog maps AAGUIDs to authenticator models
+type Catalog struct {
+	entries map[uuid.UUID]Authenticator
+}
+
+// Load reads the embedded catalog and, when path is not empty, merges the
+// entries of that file over it
+func Load(path string) (*Catalog, error) {
+	c := &Catalog{entries: make(map[uuid.UUID]Authenticator)}
+	if err := c.merge(embedded); err != nil {
+		return nil, fmt.Errorf("embedded catalog: %w", err)
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.merge(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Catalog) merge(data []byte) error {
+	var list metadata.PasskeyAuthenticator
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for key, entry := range list {
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return fmt.Errorf("invalid AAGUID %q", key)
+		}
+		c.entries[id] = Authenticator{Name: entry.Name, IconLight: entry.IconLight, IconDark: entry.IconDark}
+	}
+	return nil
+}
+
+// Len returns the number of known AAGUIDs
+func (c *Catalog) Len() int {
+	return len(c.entries)
+}
+
+// Lookup returns the authenticator model for an AAGUID
+func (c *Catalog) Lookup(aaguid []byte) (Authenticator, bool) {
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil || id == uuid.Nil {
+		return Authenticator{}, false
+	}
+	a, ok := c.entries[id]
+	return a, ok
+}
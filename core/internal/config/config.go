@@ -0,0 +1,318 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/joho/godotenv/autoload"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the whodis server
+type Config struct {
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	Database DatabaseConfig `yaml:"database" toml:"database"`
+	WebAuthn WebAuthnConfig `yaml:"webauthn" toml:"webauthn"`
+	CORS     CORSConfig     `yaml:"cors" toml:"cors"`
+	Cookie   CookieConfig   `yaml:"cookie" toml:"cookie"`
+	Session  SessionConfig  `yaml:"session" toml:"session"`
+	Ceremony CeremonyConfig `yaml:"ceremony" toml:"ceremony"`
+	OIDC     OIDCConfig     `yaml:"oidc" toml:"oidc"`
+
+	Attestation AttestationConfig `yaml:"attestation" toml:"attestation"`
+	Email       EmailConfig       `yaml:"email" toml:"email"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit" toml:"rate_limit"`
+	CSRF        CSRFConfig        `yaml:"csrf" toml:"csrf"`
+}
+
+// ServerConfig configures the HTTP listener
+type ServerConfig struct {
+	Port            int           `yaml:"port" toml:"port"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"` // grace period for in-flight requests
+	TrustedProxies  []string      `yaml:"trusted_proxies" toml:"trusted_proxies"`   // addresses or CIDR ranges allowed to set X-Forwarded-For and X-Real-IP
+}
+
+// DatabaseConfig configures the database connection
+type DatabaseConfig struct {
+	URL             string        `yaml:"url" toml:"url"`                       // postgres:// URL or SQLite file name
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"` // 0 means unlimited
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"` // 0 means connections are reused forever
+}
+
+// WebAuthnConfig describes the relying party
+type WebAuthnConfig struct {
+	RPID                 string        `yaml:"rp_id" toml:"rp_id"` // registrable domain credentials are scoped to
+	RPDisplayName        string        `yaml:"rp_display_name" toml:"rp_display_name"`
+	RPOrigins            []string      `yaml:"rp_origins" toml:"rp_origins"`                       // origins allowed to run ceremonies
+	ResidentKey          string        `yaml:"resident_key" toml:"resident_key"`                   // discouraged, preferred or required
+	CloneAction          string        `yaml:"clone_action" toml:"clone_action"`                   // warn or suspend when a credential looks cloned
+	AuthenticatorCatalog string        `yaml:"authenticator_catalog" toml:"authenticator_catalog"` // extra AAGUID names merged over the built-in list
+	HideUnknownUsers     bool          `yaml:"hide_unknown_users" toml:"hide_unknown_users"`       // answer logins for unknown usernames like real ones
+	Timeout              time.Duration `yaml:"timeout" toml:"timeout"`                             // how long a ceremony may take
+	Debug                bool          `yaml:"debug" toml:"debug"`
+}
+
+// AttestationConfig decides which authenticators may register
+type AttestationConfig struct {
+	Conveyance   string   `yaml:"conveyance" toml:"conveyance"`       // none, indirect, direct or enterprise
+	Require      bool     `yaml:"require" toml:"require"`             // reject credentials whose attestation does not chain to a trust anchor
+	TrustAnchors string   `yaml:"trust_anchors" toml:"trust_anchors"` // PEM bundle of attestation root certificates
+	MDSBlob      string   `yaml:"mds_blob" toml:"mds_blob"`           // FIDO Metadata Service BLOB downloaded ahead of time
+	MDSRoot      string   `yaml:"mds_root" toml:"mds_root"`           // PEM root the BLOB is signed under, FIDO's own root when empty
+	AllowAAGUIDs []string `yaml:"allow_aaguids" toml:"allow_aaguids"` // only these authenticator models may register when not empty
+	DenyAAGUIDs  []string `yaml:"deny_aaguids" toml:"deny_aaguids"`
+}
+
+// EmailConfig configures outgoing email and the magic links sent in it
+type EmailConfig struct {
+	Mailer       string        `yaml:"mailer" toml:"mailer"` // smtp, file or stdout
+	From         string        `yaml:"from" toml:"from"`
+	File         string        `yaml:"file" toml:"file"` // messages are appended here by the file mailer
+	SMTP         SMTPConfig    `yaml:"smtp" toml:"smtp"`
+	LinkURL      string        `yaml:"link_url" toml:"link_url"`             // frontend base URL magic links point to
+	LinkTTL      time.Duration `yaml:"link_ttl" toml:"link_ttl"`             // how long a magic link stays valid
+	LinksPerHour int           `yaml:"links_per_hour" toml:"links_per_hour"` // magic links a user may be sent per hour
+}
+
+// SMTPConfig configures the SMTP relay used by the smtp mailer
+type SMTPConfig struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"` // empty to send without authentication
+	Password string `yaml:"password" toml:"password"`
+}
+
+// CORSConfig configures cross-origin requests from the frontend
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	MaxAge         int      `yaml:"max_age" toml:"max_age"` // seconds browsers may cache preflight responses
+}
+
+// CookieConfig configures the session cookie
+type CookieConfig struct {
+	Name     string `yaml:"name" toml:"name"`
+	Domain   string `yaml:"domain" toml:"domain"`       // empty for a host-only cookie
+	Secure   bool   `yaml:"secure" toml:"secure"`       // required when served over HTTPS
+	SameSite string `yaml:"same_site" toml:"same_site"` // lax, strict or none
+}
+
+// SessionConfig configures session lifetimes
+type SessionConfig struct {
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`         // ends sessions that see no requests for this long
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout" toml:"absolute_timeout"` // ends sessions this long after login
+
+	// server keeps sessions only in the database. token hands out signed
+	// access tokens that other services can verify against the JWKS, and
+	// a refresh token for the server-side session that renews them.
+	Mode           string        `yaml:"mode" toml:"mode"`
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl" toml:"access_token_ttl"` // lifetime of access tokens in token mode
+}
+
+// CeremonyConfig configures where in-flight WebAuthn ceremonies are kept
+type CeremonyConfig struct {
+	Store string `yaml:"store" toml:"store"` // memory or database
+}
+
+// RateLimitConfig throttles the login, registration and recovery endpoints
+type RateLimitConfig struct {
+	Store    string    `yaml:"store" toml:"store"`       // memory or database
+	IP       RateLimit `yaml:"ip" toml:"ip"`             // per client address
+	Username RateLimit `yaml:"username" toml:"username"` // per username tried, from any address
+}
+
+// RateLimit is a token bucket holding Burst requests, refilled at one
+// request per Interval. A zero Burst turns the limit off.
+type RateLimit struct {
+	Burst    int           `yaml:"burst" toml:"burst"`
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+}
+
+// CSRFConfig configures cross-site request forgery protection of
+// state-changing requests
+type CSRFConfig struct {
+	// origin trusts the Origin header, double_submit needs a token from
+	// GET /csrf echoed in the X-CSRF-Token header
+	Mode string `yaml:"mode" toml:"mode"`
+}
+
+// OIDCConfig configures the OpenID Connect provider
+type OIDCConfig struct {
+	Issuer   string       `yaml:"issuer" toml:"issuer"`       // public base URL of this server
+	LoginURL string       `yaml:"login_url" toml:"login_url"` // frontend page users are sent to when not logged in
+	Clients  []OIDCClient `yaml:"clients" toml:"clients"`
+
+	// KeyRotation is how often a new signing key takes over for ID, access
+	// and session tokens; 0 keeps the first key forever
+	KeyRotation time.Duration `yaml:"key_rotation" toml:"key_rotation"`
+}
+
+const (
+	// SigningKeyActivation holds a new signing key back from signing until
+	// every replica has loaded it and can verify its tokens
+	SigningKeyActivation = 10 * time.Minute
+	// OIDCTokenTTL is the lifetime of issued ID and access tokens
+	OIDCTokenTTL = 10 * time.Minute
+)
+
+// OIDCClient is a relying party allowed to use the OpenID Connect endpoints
+type OIDCClient struct {
+	ID           string   `json:"id" yaml:"id" toml:"id"`
+	Secret       string   `json:"secret" yaml:"secret" toml:"secret"` // empty for public clients, which must use PKCE
+	RedirectURIs []string `json:"redirectURIs" yaml:"redirect_uris" toml:"redirect_uris"`
+}
+
+// Default returns the configuration used for local development
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            8080,
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     time.Minute,
+			ShutdownTimeout: 5 * time.Second,
+		},
+		Database: DatabaseConfig{
+			URL:          "whodis.db",
+			MaxIdleConns: 2,
+		},
+		WebAuthn: WebAuthnConfig{
+			RPID:          "localhost",
+			RPDisplayName: "My App",
+			RPOrigins:     []string{"http://localhost:3000"},
+			ResidentKey:   "discouraged",
+			CloneAction:   "suspend",
+			Timeout:       5 * time.Minute,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"http://localhost:3000"},
+			MaxAge:         300, // Maximum value not ignored by any of major browsers
+		},
+		Cookie: CookieConfig{
+			Name:     "sessionID",
+			SameSite: "lax",
+		},
+		Session: SessionConfig{
+			IdleTimeout:     2 * time.Hour,
+			AbsoluteTimeout: 24 * time.Hour,
+			Mode:            "server",
+			AccessTokenTTL:  5 * time.Minute,
+		},
+		Ceremony: CeremonyConfig{
+			Store: "database",
+		},
+		OIDC: OIDCConfig{
+			Issuer:      "http://localhost:8080",
+			LoginURL:    "http://localhost:3000/login",
+			KeyRotation: 30 * 24 * time.Hour,
+		},
+		Attestation: AttestationConfig{
+			Conveyance: "none",
+		},
+		Email: EmailConfig{
+			Mailer:       "stdout",
+			From:         "whodis <no-reply@localhost>",
+			SMTP:         SMTPConfig{Port: 587},
+			LinkURL:      "http://localhost:3000",
+			LinkTTL:      15 * time.Minute,
+			LinksPerHour: 5,
+		},
+		CSRF: CSRFConfig{
+			Mode: "origin",
+		},
+		RateLimit: RateLimitConfig{
+			Store:    "memory",
+			IP:       RateLimit{Burst: 30, Interval: 2 * time.Second},
+			Username: RateLimit{Burst: 10, Interval: time.Minute},
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, an optional config file,
+// environment variables and command-line flags, each overriding the one
+// before. The file is named by the -config flag or CONFIG_FILE. Load returns
+// the arguments left after the flags.
+func Load(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("whodis", flag.ExitOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+
+	// Flags are applied last, once the file and environment are loaded
+	flagValues := make(map[*setting]string)
+	for i := range settings {
+		s := &settings[i]
+		if s.flag == "" {
+			continue
+		}
+		record := func(value string) error {
+			flagValues[s] = value
+			return nil
+		}
+		// Boolean flags may be given without a value
+		if _, ok := s.field(Default()).(*bool); ok {
+			fs.BoolFunc(s.flag, s.usage, record)
+		} else {
+			fs.Func(s.flag, s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i := range settings {
+		s := &settings[i]
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := set(s.field(c), value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	for s, value := range flagValues {
+		if err := set(s.field(c), value); err != nil {
+			return nil, nil, fmt.Errorf("-%s: %w", s.flag, err)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+// loadFile decodes a YAML or TOML file, chosen by extension, over c
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("config file %s: unknown format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
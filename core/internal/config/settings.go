@@ -0,0 +1,133 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is a configuration value that can be set from the environment
+// and, when flag is not empty, from the command line
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) any // pointer to the field in c
+}
+
+// settings lists every value settable outside the config file. Environment
+// names predating this package are kept so existing .env files still work.
+var settings = []setting{
+	{"port", "PORT", "HTTP listen port", func(c *Config) any { return &c.Server.Port }},
+	{"read-timeout", "SERVER_READ_TIMEOUT", "maximum duration for reading a request", func(c *Config) any { return &c.Server.ReadTimeout }},
+	{"write-timeout", "SERVER_WRITE_TIMEOUT", "maximum duration for writing a response", func(c *Config) any { return &c.Server.WriteTimeout }},
+	{"idle-timeout", "SERVER_IDLE_TIMEOUT", "how long idle keep-alive connections stay open", func(c *Config) any { return &c.Server.IdleTimeout }},
+	{"shutdown-timeout", "SERVER_SHUTDOWN_TIMEOUT", "grace period for in-flight requests on shutdown", func(c *Config) any { return &c.Server.ShutdownTimeout }},
+	{"trusted-proxies", "SERVER_TRUSTED_PROXIES", "comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP are believed", func(c *Config) any { return &c.Server.TrustedProxies }},
+
+	{"db-url", "BLUEPRINT_DB_URL", "postgres:// URL or SQLite file name", func(c *Config) any { return &c.Database.URL }},
+	{"db-max-open-conns", "DB_MAX_OPEN_CONNS", "maximum open database connections, 0 for unlimited", func(c *Config) any { return &c.Database.MaxOpenConns }},
+	{"db-max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum idle database connections", func(c *Config) any { return &c.Database.MaxIdleConns }},
+	{"db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "maximum lifetime of a database connection, 0 for no limit", func(c *Config) any { return &c.Database.ConnMaxLifetime }},
+
+	{"rp-id", "WEBAUTHN_RP_ID", "relying party ID, the domain credentials are scoped to", func(c *Config) any { return &c.WebAuthn.RPID }},
+	{"rp-display-name", "WEBAUTHN_RP_DISPLAY_NAME", "relying party name shown by authenticators", func(c *Config) any { return &c.WebAuthn.RPDisplayName }},
+	{"rp-origins", "WEBAUTHN_RP_ORIGINS", "comma-separated origins allowed to run WebAuthn ceremonies", func(c *Config) any { return &c.WebAuthn.RPOrigins }},
+	{"resident-key", "WEBAUTHN_RESIDENT_KEY", "discoverable credential requirement: discouraged, preferred or required", func(c *Config) any { return &c.WebAuthn.ResidentKey }},
+	{"clone-action", "WEBAUTHN_CLONE_ACTION", "what to do when a credential looks cloned: warn or suspend", func(c *Config) any { return &c.WebAuthn.CloneAction }},
+	{"authenticator-catalog", "WEBAUTHN_AUTHENTICATOR_CATALOG", "JSON file of authenticator names by AAGUID, merged over the built-in list", func(c *Config) any { return &c.WebAuthn.AuthenticatorCatalog }},
+	{"hide-unknown-users", "WEBAUTHN_HIDE_UNKNOWN_USERS", "answer logins for unknown usernames with a decoy challenge instead of 404", func(c *Config) any { return &c.WebAuthn.HideUnknownUsers }},
+	{"webauthn-timeout", "WEBAUTHN_TIMEOUT", "how long a WebAuthn ceremony may take", func(c *Config) any { return &c.WebAuthn.Timeout }},
+	{"webauthn-debug", "WEBAUTHN_DEBUG", "log WebAuthn debug information", func(c *Config) any { return &c.WebAuthn.Debug }},
+
+	{"cors-origins", "CORS_ALLOWED_ORIGINS", "comma-separated origins allowed to make cross-origin requests", func(c *Config) any { return &c.CORS.AllowedOrigins }},
+	{"cors-max-age", "CORS_MAX_AGE", "seconds browsers may cache preflight responses", func(c *Config) any { return &c.CORS.MaxAge }},
+
+	{"cookie-name", "COOKIE_NAME", "session cookie name", func(c *Config) any { return &c.Cookie.Name }},
+	{"cookie-domain", "COOKIE_DOMAIN", "session cookie domain, empty for a host-only cookie", func(c *Config) any { return &c.Cookie.Domain }},
+	{"cookie-secure", "COOKIE_SECURE", "only send the session cookie over HTTPS", func(c *Config) any { return &c.Cookie.Secure }},
+	{"cookie-same-site", "COOKIE_SAME_SITE", "session cookie SameSite mode: lax, strict or none", func(c *Config) any { return &c.Cookie.SameSite }},
+
+	{"session-idle-timeout", "SESSION_IDLE_TIMEOUT", "end sessions that see no requests for this long", func(c *Config) any { return &c.Session.IdleTimeout }},
+	{"session-absolute-timeout", "SESSION_ABSOLUTE_TIMEOUT", "end sessions this long after login", func(c *Config) any { return &c.Session.AbsoluteTimeout }},
+	{"session-mode", "SESSION_MODE", "server for database sessions, token for signed access and refresh tokens", func(c *Config) any { return &c.Session.Mode }},
+	{"session-access-token-ttl", "SESSION_ACCESS_TOKEN_TTL", "lifetime of access tokens in token session mode", func(c *Config) any { return &c.Session.AccessTokenTTL }},
+
+	{"csrf-mode", "CSRF_MODE", "cross-site request forgery protection: origin or double_submit", func(c *Config) any { return &c.CSRF.Mode }},
+
+	{"ceremony-store", "CEREMONY_STORE", "where in-flight ceremonies are kept: memory or database", func(c *Config) any { return &c.Ceremony.Store }},
+
+	{"oidc-issuer", "OIDC_ISSUER", "public base URL of the OpenID Connect provider", func(c *Config) any { return &c.OIDC.Issuer }},
+	{"oidc-login-url", "OIDC_LOGIN_URL", "login page for OpenID Connect authorization requests", func(c *Config) any { return &c.OIDC.LoginURL }},
+	{"oidc-key-rotation", "OIDC_KEY_ROTATION", "how often a new token signing key takes over, 0 to never rotate", func(c *Config) any { return &c.OIDC.KeyRotation }},
+	// Client secrets do not belong on the command line
+	{"", "OIDC_CLIENTS", "OpenID Connect clients as a JSON array", func(c *Config) any { return &c.OIDC.Clients }},
+
+	{"attestation", "ATTESTATION_CONVEYANCE", "attestation requested at registration: none, indirect, direct or enterprise", func(c *Config) any { return &c.Attestation.Conveyance }},
+	{"attestation-require", "ATTESTATION_REQUIRE", "reject credentials whose attestation does not chain to a trust anchor", func(c *Config) any { return &c.Attestation.Require }},
+	{"attestation-trust-anchors", "ATTESTATION_TRUST_ANCHORS", "PEM bundle of attestation root certificates", func(c *Config) any { return &c.Attestation.TrustAnchors }},
+	{"attestation-mds-blob", "ATTESTATION_MDS_BLOB", "FIDO Metadata Service BLOB file", func(c *Config) any { return &c.Attestation.MDSBlob }},
+	{"attestation-mds-root", "ATTESTATION_MDS_ROOT", "PEM root certificate the metadata BLOB is signed under", func(c *Config) any { return &c.Attestation.MDSRoot }},
+	{"attestation-allow-aaguids", "ATTESTATION_ALLOW_AAGUIDS", "comma-separated AAGUIDs allowed to register", func(c *Config) any { return &c.Attestation.AllowAAGUIDs }},
+	{"attestation-deny-aaguids", "ATTESTATION_DENY_AAGUIDS", "comma-separated AAGUIDs refused at registration", func(c *Config) any { return &c.Attestation.DenyAAGUIDs }},
+
+	{"mailer", "EMAIL_MAILER", "how email is sent: smtp, file or stdout", func(c *Config) any { return &c.Email.Mailer }},
+	{"email-from", "EMAIL_FROM", "sender address of outgoing email", func(c *Config) any { return &c.Email.From }},
+	{"email-file", "EMAIL_FILE", "file the file mailer appends messages to", func(c *Config) any { return &c.Email.File }},
+	{"smtp-host", "SMTP_HOST", "SMTP relay host", func(c *Config) any { return &c.Email.SMTP.Host }},
+	{"smtp-port", "SMTP_PORT", "SMTP relay port", func(c *Config) any { return &c.Email.SMTP.Port }},
+	{"smtp-username", "SMTP_USERNAME", "SMTP user, empty to send without authentication", func(c *Config) any { return &c.Email.SMTP.Username }},
+	// Passwords do not belong on the command line
+	{"", "SMTP_PASSWORD", "SMTP password", func(c *Config) any { return &c.Email.SMTP.Password }},
+	{"email-link-url", "EMAIL_LINK_URL", "frontend base URL magic links point to", func(c *Config) any { return &c.Email.LinkURL }},
+	{"email-link-ttl", "EMAIL_LINK_TTL", "how long a magic link stays valid", func(c *Config) any { return &c.Email.LinkTTL }},
+	{"email-links-per-hour", "EMAIL_LINKS_PER_HOUR", "magic links a user may be sent per hour", func(c *Config) any { return &c.Email.LinksPerHour }},
+
+	{"rate-limit-store", "RATE_LIMIT_STORE", "where rate limits are counted: memory or database", func(c *Config) any { return &c.RateLimit.Store }},
+	{"rate-limit-ip-burst", "RATE_LIMIT_IP_BURST", "requests a client address may make at once, 0 for no limit", func(c *Config) any { return &c.RateLimit.IP.Burst }},
+	{"rate-limit-ip-interval", "RATE_LIMIT_IP_INTERVAL", "time for a client address to earn another request", func(c *Config) any { return &c.RateLimit.IP.Interval }},
+	{"rate-limit-username-burst", "RATE_LIMIT_USERNAME_BURST", "requests for one username allowed at once, 0 for no limit", func(c *Config) any { return &c.RateLimit.Username.Burst }},
+	{"rate-limit-username-interval", "RATE_LIMIT_USERNAME_INTERVAL", "time for a username to earn another request", func(c *Config) any { return &c.RateLimit.Username.Interval }},
+}
+
+// set parses value into the field ptr points to. Lists are comma separated;
+// anything else that is not a scalar is decoded as JSON.
+func set(ptr any, value string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *[]string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*p = list
+	default:
+		if err := json.Unmarshal([]byte(value), ptr); err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+	}
+	return nil
+}
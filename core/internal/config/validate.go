@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Validate reports every invalid setting at once. Settings are named by
+// their config file keys.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			fail(key, "must be positive, got %s", d)
+		}
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		fail("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	positive("server.read_timeout", c.Server.ReadTimeout)
+	positive("server.write_timeout", c.Server.WriteTimeout)
+	positive("server.idle_timeout", c.Server.IdleTimeout)
+	positive("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := ParseTrustedProxy(proxy); err != nil {
+			fail("server.trusted_proxies", "%v", err)
+		}
+	}
+
+	if c.Database.URL == "" {
+		fail("database.url", "is required")
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 {
+		fail("database", "connection limits must not be negative")
+	}
+	if c.Database.ConnMaxLifetime < 0 {
+		fail("database.conn_max_lifetime", "must not be negative")
+	}
+
+	rpID := c.WebAuthn.RPID
+	if rpID == "" || strings.ContainsAny(rpID, ":/") {
+		fail("webauthn.rp_id", "must be a domain name without scheme or port, got %q", rpID)
+	}
+	if c.WebAuthn.RPDisplayName == "" {
+		fail("webauthn.rp_display_name", "is required")
+	}
+	if len(c.WebAuthn.RPOrigins) == 0 {
+		fail("webauthn.rp_origins", "at least one origin is required")
+	}
+	for _, origin := range c.WebAuthn.RPOrigins {
+		u, err := parseOrigin(origin)
+		if err != nil {
+			fail("webauthn.rp_origins", "%v", err)
+			continue
+		}
+		// Browsers refuse ceremonies for an RP ID the origin is not within
+		host := u.Hostname()
+		if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+			fail("webauthn.rp_origins", "%s is not within rp_id %q", origin, rpID)
+		}
+		if u.Scheme != "https" && host != "localhost" {
+			fail("webauthn.rp_origins", "%s must use https", origin)
+		}
+	}
+	if !slices.Contains([]string{"discouraged", "preferred", "required"}, c.WebAuthn.ResidentKey) {
+		fail("webauthn.resident_key", "must be discouraged, preferred or required, got %q", c.WebAuthn.ResidentKey)
+	}
+	if c.WebAuthn.CloneAction != "warn" && c.WebAuthn.CloneAction != "suspend" {
+		fail("webauthn.clone_action", "must be warn or suspend, got %q", c.WebAuthn.CloneAction)
+	}
+	positive("webauthn.timeout", c.WebAuthn.Timeout)
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		// Credentialed requests cannot use a wildcard origin
+		if _, err := parseOrigin(origin); err != nil {
+			fail("cors.allowed_origins", "%v", err)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		fail("cors.max_age", "must not be negative")
+	}
+
+	if c.Cookie.Name == "" {
+		fail("cookie.name", "is required")
+	}
+	switch c.Cookie.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Cookie.Secure {
+			fail("cookie.same_site", "none requires cookie.secure")
+		}
+	default:
+		fail("cookie.same_site", "must be lax, strict or none, got %q", c.Cookie.SameSite)
+	}
+	// Secure host-only cookies get the prefix added automatically
+	if strings.HasPrefix(c.Cookie.Name, "__Host-") && (!c.Cookie.Secure || c.Cookie.Domain != "") {
+		fail("cookie.name", "__Host- cookies need cookie.secure and no cookie.domain")
+	}
+
+	if c.CSRF.Mode != "origin" && c.CSRF.Mode != "double_submit" {
+		fail("csrf.mode", "must be origin or double_submit, got %q", c.CSRF.Mode)
+	}
+
+	positive("session.idle_timeout", c.Session.IdleTimeout)
+	positive("session.absolute_timeout", c.Session.AbsoluteTimeout)
+	if c.Session.IdleTimeout > c.Session.AbsoluteTimeout {
+		fail("session.idle_timeout", "must not exceed session.absolute_timeout")
+	}
+	switch c.Session.Mode {
+	case "server":
+	case "token":
+		positive("session.access_token_ttl", c.Session.AccessTokenTTL)
+		// Refreshing is what keeps the session from idling out
+		if c.Session.AccessTokenTTL > c.Session.IdleTimeout {
+			fail("session.access_token_ttl", "must not exceed session.idle_timeout")
+		}
+	default:
+		fail("session.mode", "must be server or token, got %q", c.Session.Mode)
+	}
+
+	if c.Ceremony.Store != "memory" && c.Ceremony.Store != "database" {
+		fail("ceremony.store", "must be memory or database, got %q", c.Ceremony.Store)
+	}
+
+	if !isAbsoluteURL(c.OIDC.Issuer) {
+		fail("oidc.issuer", "must be an absolute URL, got %q", c.OIDC.Issuer)
+	}
+	if !isAbsoluteURL(c.OIDC.LoginURL) {
+		fail("oidc.login_url", "must be an absolute URL, got %q", c.OIDC.LoginURL)
+	}
+	if c.OIDC.KeyRotation < 0 {
+		fail("oidc.key_rotation", "must not be negative")
+	} else if c.OIDC.KeyRotation > 0 {
+		// A replaced key stays published for one more rotation period, which
+		// must outlast everything it signed, and a new key has to activate
+		// before the next one is generated
+		minimum := max(SigningKeyActivation, OIDCTokenTTL, c.Email.LinkTTL)
+		if c.Session.Mode == "token" {
+			minimum = max(minimum, c.Session.AccessTokenTTL)
+		}
+		if c.OIDC.KeyRotation < minimum {
+			fail("oidc.key_rotation", "must be 0 or at least %s, the key activation delay and lifetime of signed tokens and links, got %s", minimum, c.OIDC.KeyRotation)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, client := range c.OIDC.Clients {
+		if client.ID == "" {
+			fail("oidc.clients", "every client needs an id")
+			continue
+		}
+		if seen[client.ID] {
+			fail("oidc.clients", "duplicate client id %q", client.ID)
+		}
+		seen[client.ID] = true
+
+		if len(client.RedirectURIs) == 0 {
+			fail("oidc.clients", "client %q has no redirect_uris", client.ID)
+		}
+		for _, uri := range client.RedirectURIs {
+			if !isAbsoluteURL(uri) || strings.Contains(uri, "#") {
+				fail("oidc.clients", "client %q: redirect URI %q must be absolute and without a fragment", client.ID, uri)
+			}
+		}
+	}
+
+	a := c.Attestation
+	if !slices.Contains([]string{"none", "indirect", "direct", "enterprise"}, a.Conveyance) {
+		fail("attestation.conveyance", "must be none, indirect, direct or enterprise, got %q", a.Conveyance)
+	}
+	if a.Require {
+		// Nothing could ever satisfy the requirement otherwise
+		if a.Conveyance == "none" {
+			fail("attestation.require", "needs attestation.conveyance other than none")
+		}
+		if a.TrustAnchors == "" && a.MDSBlob == "" {
+			fail("attestation.require", "needs attestation.trust_anchors or attestation.mds_blob")
+		}
+	}
+	if a.MDSRoot != "" && a.MDSBlob == "" {
+		fail("attestation.mds_root", "is only used with attestation.mds_blob")
+	}
+	aaguids := func(key string, list []string) {
+		for _, aaguid := range list {
+			if _, err := uuid.Parse(aaguid); err != nil {
+				fail(key, "%q is not an AAGUID", aaguid)
+			}
+		}
+	}
+	aaguids("attestation.allow_aaguids", a.AllowAAGUIDs)
+	aaguids("attestation.deny_aaguids", a.DenyAAGUIDs)
+
+	e := c.Email
+	switch e.Mailer {
+	case "stdout":
+	case "file":
+		if e.File == "" {
+			fail("email.file", "is required by the file mailer")
+		}
+	case "smtp":
+		if e.SMTP.Host == "" {
+			fail("email.smtp.host", "is required by the smtp mailer")
+		}
+		if e.SMTP.Port < 1 || e.SMTP.Port > 65535 {
+			fail("email.smtp.port", "must be between 1 and 65535, got %d", e.SMTP.Port)
+		}
+	default:
+		fail("email.mailer", "must be smtp, file or stdout, got %q", e.Mailer)
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		fail("email.from", "%v", err)
+	}
+	if !isAbsoluteURL(e.LinkURL) {
+		fail("email.link_url", "must be an absolute URL, got %q", e.LinkURL)
+	}
+	positive("email.link_ttl", e.LinkTTL)
+	if e.LinksPerHour < 1 {
+		fail("email.links_per_hour", "must be at least 1, got %d", e.LinksPerHour)
+	}
+
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "database" {
+		fail("rate_limit.store", "must be memory or database, got %q", c.RateLimit.Store)
+	}
+	rateLimit := func(key string, limit RateLimit) {
+		if limit.Burst < 0 {
+			fail(key+".burst", "must not be negative")
+		}
+		if limit.Burst > 0 {
+			positive(key+".interval", limit.Interval)
+		}
+	}
+	rateLimit("rate_limit.ip", c.RateLimit.IP)
+	rateLimit("rate_limit.username", c.RateLimit.Username)
+
+	return errors.Join(errs...)
+}
+
+// parseOrigin parses a scheme://host[:port] origin
+func parseOrigin(origin string) (*url.URL, error) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("%q is not an origin like https://example.com", origin)
+	}
+	return u, nil
+}
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// ParseTrustedProxy parses a trusted_proxies entry, a CIDR range or a single
+// address
+func ParseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(proxy); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an address or CIDR range", proxy)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
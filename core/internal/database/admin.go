@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// UserFilter selects users, ordered by name. Zero fields match every user.
+type UserFilter struct {
+	Query  string // part of the name, display name or email, ignoring case
+	Cursor string // ID of the last user of the previous page
+	Limit  int
+}
+
+// ListUsers returns the users matching filter, without their credentials
+func (s *service) ListUsers(ctx context.Context, filter UserFilter) ([]models.User, error) {
+	var where []string
+	var args []any
+
+	if filter.Query != "" {
+		// Match the query literally, not as a LIKE pattern
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(filter.Query)) + "%"
+		where = append(where, `(LOWER(name) LIKE ? ESCAPE '\' OR LOWER(display_name) LIKE ? ESCAPE '\' OR LOWER(COALESCE(email, '')) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if filter.Cursor != "" {
+		var name string
+		err := s.db.QueryRowContext(ctx, `SELECT name FROM users WHERE id = ?`, filter.Cursor).Scan(&name)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, "(name > ? OR (name = ? AND id > ?))")
+		args = append(args, name, name, filter.Cursor)
+	}
+
+	query := `
+		SELECT ` + userColumns + `
+		FROM users`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+	query += "\n\t\tORDER BY name, id"
+	if filter.Limit > 0 {
+		query += "\n\t\tLIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// SetUserRole changes a user's role
+func (s *service) SetUserRole(ctx context.Context, userID, role string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE users SET role = ? WHERE id = ?
+	`, role, userID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// SetUserDisabled disables the account at the given time, or enables it
+// again when disabledAt is nil
+func (s *service) SetUserDisabled(ctx context.Context, userID string, disabledAt *time.Time) error {
+	var value any
+	if disabledAt != nil {
+		value = disabledAt.UTC()
+	}
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE users SET disabled_at = ? WHERE id = ?
+	`, value, userID)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+// ListUserSessions returns a user's sessions that are neither revoked nor
+// past their absolute expiry, newest first
+func (s *service) ListUserSessions(ctx context.Context, userID string, now time.Time) ([]models.Session, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, created_at, last_seen_at, expires_at, scope
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+	`, userID, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&session.Scope,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// requireRow turns an update that matched nothing into ErrUserNotFound
+func requireRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
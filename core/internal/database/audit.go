@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditFilter selects audit events, newest first. Zero fields match every event.
+type AuditFilter struct {
+	UserID string
+	Types  []string
+	Since  time.Time // events at or after
+	Until  time.Time // events before
+	Cursor string    // ID of the last event of the previous page
+	Limit  int
+}
+
+// RecordAuditEvent appends an event to the audit log. Events are never
+// updated or deleted.
+func (s *service) RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	event.ID = uuid.New().String()
+
+	details := []byte("{}")
+	if len(event.Details) > 0 {
+		var err error
+		details, err = json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_events (id, user_id, type, credential_id, aaguid, ip, user_agent, details, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.ID, event.UserID, event.Type, event.CredentialID, event.AAGUID, event.IP, event.UserAgent, string(details), event.CreatedAt.UTC())
+	return err
+}
+
+// ListAuditEvents returns the events matching filter, newest first
+func (s *service) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	var where []string
+	var args []any
+
+	if filter.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if len(filter.Types) > 0 {
+		where = append(where, "type IN (?"+strings.Repeat(", ?", len(filter.Types)-1)+")")
+		for _, t := range filter.Types {
+			args = append(args, t)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	if filter.Cursor != "" {
+		// Continue below the previous page's last event; ties on created_at
+		// are broken by ID so no event is skipped or repeated
+		var createdAt time.Time
+		err := s.db.QueryRowContext(ctx, `
+			SELECT created_at FROM audit_events WHERE id = ?
+		`, filter.Cursor).Scan(&createdAt)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, createdAt, createdAt, filter.Cursor)
+	}
+
+	query := `
+		SELECT id, user_id, type, credential_id, aaguid, ip, user_agent, details, created_at
+		FROM audit_events`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+	query += "\n\t\tORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += "\n\t\tLIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var event models.AuditEvent
+		var details string
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Type,
+			&event.CredentialID,
+			&event.AAGUID,
+			&event.IP,
+			&event.UserAgent,
+			&details,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(details), &event.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"time"
+)
+
+// SaveCeremony stores the state of an in-flight WebAuthn ceremony
+func (s *service) SaveCeremony(ctx context.Context, ceremony *models.Ceremony) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO ceremonies (id, data, expires_at) VALUES (?, ?, ?)
+	`, ceremony.ID, ceremony.Data, ceremony.ExpiresAt.UTC())
+	return err
+}
+
+// TakeCeremony deletes an unexpired ceremony and returns it. When requests
+// race for the same ceremony only the one whose delete removed the row gets
+// it; the others see nil as if it never existed.
+func (s *service) TakeCeremony(ctx context.Context, id string) (*models.Ceremony, error) {
+	var ceremony models.Ceremony
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, data, expires_at FROM ceremonies WHERE id = ? AND expires_at > ?
+	`, id, time.Now().UTC()).Scan(&ceremony.ID, &ceremony.Data, &ceremony.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Ceremony not found or expired
+		}
+		return nil, err
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM ceremonies WHERE id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n != 1 {
+		return nil, nil // Taken by a concurrent request
+	}
+	return &ceremony, nil
+}
+
+// DeleteCeremony removes a ceremony by its ID
+func (s *service) DeleteCeremony(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM ceremonies WHERE id = ?
+	`, id)
+	return err
+}
+
+// DeleteExpiredCeremonies removes every ceremony that expired before the given time
+func (s *service) DeleteExpiredCeremonies(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM ceremonies WHERE expires_at <= ?
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/google/uuid"
+)
+
+// credentialColumns lists the credentials columns read by scanCredential
+const credentialColumns = `
+	id,
+	user_id,
+	credential_id,
+	public_key,
+	sign_count,
+	aaguid,
+	clone_warning,
+	attachment,
+	transports,
+	user_present,
+	user_verified,
+	backup_eligible,
+	backup_state,
+	flags_recorded,
+	nickname,
+	created_at,
+	last_used_at,
+	suspended_at
+`
+
+// scanCredential reads a row selected with credentialColumns
+func scanCredential(row interface{ Scan(dest ...any) error }) (*models.Credential, error) {
+	var cred models.Credential
+	var attachmentStr, transports string
+	var lastUsedAt, suspendedAt sql.NullTime
+	err := row.Scan(
+		&cred.ID,
+		&cred.UserID,
+		&cred.CredentialID,
+		&cred.PublicKey,
+		&cred.SignCount,
+		&cred.AAGUID,
+		&cred.CloneWarning,
+		&attachmentStr,
+		&transports,
+		&cred.UserPresent,
+		&cred.UserVerified,
+		&cred.BackupEligible,
+		&cred.BackupState,
+		&cred.FlagsRecorded,
+		&cred.Nickname,
+		&cred.CreatedAt,
+		&lastUsedAt,
+		&suspendedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cred.Attachment = protocol.AuthenticatorAttachment(attachmentStr)
+	cred.Transports = splitTransports(transports)
+	if lastUsedAt.Valid {
+		cred.LastUsedAt = &lastUsedAt.Time
+	}
+	if suspendedAt.Valid {
+		cred.SuspendedAt = &suspendedAt.Time
+	}
+	return &cred, nil
+}
+
+// joinTransports encodes transports for the transports column. Values are
+// opaque hints passed back to the browser, so unknown ones are kept.
+func joinTransports(transports []protocol.AuthenticatorTransport) string {
+	var list []string
+	for _, t := range transports {
+		if t != "" && !strings.Contains(string(t), ",") {
+			list = append(list, string(t))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// splitTransports decodes the transports column
+func splitTransports(value string) []protocol.AuthenticatorTransport {
+	if value == "" {
+		return nil
+	}
+	var transports []protocol.AuthenticatorTransport
+	for _, t := range strings.Split(value, ",") {
+		transports = append(transports, protocol.AuthenticatorTransport(t))
+	}
+	return transports
+}
+
+// GetCredential retrieves the stored record of a WebAuthn credential
+func (s *service) GetCredential(ctx context.Context, credentialID []byte) (*models.Credential, error) {
+	cred, err := scanCredential(s.db.QueryRowContext(ctx, `
+		SELECT `+credentialColumns+`
+		FROM credentials
+		WHERE credential_id = ?
+	`, credentialID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Credential not found
+		}
+		return nil, err
+	}
+	return cred, nil
+}
+
+// ListCredentialsForUser retrieves the stored credential records of a user, oldest first
+func (s *service) ListCredentialsForUser(ctx context.Context, userID string) ([]models.Credential, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+credentialColumns+`
+		FROM credentials
+		WHERE user_id = ?
+		ORDER BY created_at, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []models.Credential
+	for rows.Next() {
+		cred, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *cred)
+	}
+	return credentials, rows.Err()
+}
+
+// RenameCredential sets the friendly name of one of the user's credentials
+func (s *service) RenameCredential(ctx context.Context, userID, id, nickname string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE credentials SET nickname = ? WHERE id = ? AND user_id = ?
+	`, nickname, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// DeleteCredential removes one of the user's credentials, refusing to remove
+// the last one that is not suspended, as suspended ones cannot log in
+func (s *service) DeleteCredential(ctx context.Context, userID, id string) error {
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		var owned, usable int
+		err := tx.QueryRowContext(ctx, `
+			SELECT
+				COUNT(CASE WHEN id = ? THEN 1 END),
+				COUNT(CASE WHEN id <> ? AND suspended_at IS NULL THEN 1 END)
+			FROM credentials WHERE user_id = ?
+		`, id, id, userID).Scan(&owned, &usable)
+		if err != nil {
+			return err
+		}
+		if owned == 0 {
+			return ErrCredentialNotFound
+		}
+		if usable == 0 {
+			return ErrLastCredential
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM credentials WHERE id = ? AND user_id = ?
+		`, id, userID)
+		return err
+	})
+}
+
+// RecordCloneEvent stores a suspected clone of a credential and raises its
+// clone warning, suspending the credential as well when suspend is set
+func (s *service) RecordCloneEvent(ctx context.Context, event *models.CloneEvent, suspend bool) error {
+	event.ID = uuid.New().String()
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO clone_events (id, credential_id, user_id, sign_count, action, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, event.ID, event.CredentialID, event.UserID, event.SignCount, event.Action, event.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		var suspendedAt *time.Time
+		if suspend {
+			at := event.CreatedAt.UTC()
+			suspendedAt = &at
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE credentials
+			SET clone_warning = ?, suspended_at = COALESCE(suspended_at, ?)
+			WHERE id = ?
+		`, true, suspendedAt, event.CredentialID)
+		return err
+	})
+}
+
+// ReinstateCredential clears the clone warning and suspension of a credential
+// and resets its signature counter, so the next login sets a new baseline.
+// An empty userID reinstates the credential whoever owns it.
+func (s *service) ReinstateCredential(ctx context.Context, userID, id string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE credentials
+		SET clone_warning = ?, suspended_at = NULL, sign_count = 0
+		WHERE id = ? AND (? = '' OR user_id = ?)
+	`, false, id, userID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
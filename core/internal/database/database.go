@@ -2,57 +2,175 @@ package database
 
 import (
 	"context"
+	"core/internal/config"
 	"core/internal/models"
 	"database/sql"
+	"errors"
 	"log"
-	"os"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
-	_ "github.com/joho/godotenv/autoload"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Service interface {
 	Close() error
-	CreateTables(ctx context.Context) error
+
+	// Schema migrations
+	Migrate(ctx context.Context) error
+	MigrateTo(ctx context.Context, version int) error
+	SchemaVersion(ctx context.Context) (int, error)
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
 
 	// User-related methods
 	GetUserByID(ctx context.Context, id string) (*models.User, error)
 	GetUserByName(ctx context.Context, name string) (*models.User, error)
+	GetUserByCredentialID(ctx context.Context, credentialID []byte) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
 	SaveUser(ctx context.Context, user *models.User) error
+	CreateUserWithCredential(ctx context.Context, user *models.User, credential *models.Credential, recoveryCodeHashes []string) error
+
+	// Administration methods
+	ListUsers(ctx context.Context, filter UserFilter) ([]models.User, error)
+	SetUserRole(ctx context.Context, userID, role string) error
+	SetUserDisabled(ctx context.Context, userID string, disabledAt *time.Time) error
+	ListUserSessions(ctx context.Context, userID string, now time.Time) ([]models.Session, error)
 
 	// Credential-related methods
 	SaveCredential(ctx context.Context, credential *models.Credential) error
+	GetCredential(ctx context.Context, credentialID []byte) (*models.Credential, error)
 	GetCredentialsForUser(ctx context.Context, userID string) ([]webauthn.Credential, error)
-	UpdateCredentialSignCount(ctx context.Context, credentialID []byte, signCount uint32) error
-}
+	UpdateCredentialAfterLogin(ctx context.Context, credentialID []byte, signCount uint32, flags webauthn.CredentialFlags) error
+	ListCredentialsForUser(ctx context.Context, userID string) ([]models.Credential, error)
+	RenameCredential(ctx context.Context, userID, id, nickname string) error
+	DeleteCredential(ctx context.Context, userID, id string) error
+	RecordCloneEvent(ctx context.Context, event *models.CloneEvent, suspend bool) error
+	ReinstateCredential(ctx context.Context, userID, id string) error
 
-type service struct {
-	db *sql.DB
+	// Recovery code-related methods
+	ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error
+	ConsumeRecoveryCode(ctx context.Context, userID, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID string) (int, error)
+
+	// Email-related methods
+	SetUserEmail(ctx context.Context, userID, email string) error
+	VerifyUserEmail(ctx context.Context, userID, email string) error
+	CreateEmailLink(ctx context.Context, link *models.EmailLink) error
+	CountEmailLinks(ctx context.Context, userID string, since time.Time) (int, error)
+	ConsumeEmailLink(ctx context.Context, id string) (*models.EmailLink, error)
+	DeleteExpiredEmailLinks(ctx context.Context, before time.Time) (int64, error)
+
+	// Audit log methods
+	RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error)
+
+	// Rate limit methods
+	TakeRateLimits(ctx context.Context, buckets map[string]config.RateLimit, now time.Time) (time.Duration, error)
+	DeleteExpiredRateLimits(ctx context.Context, before time.Time) (int64, error)
+
+	// Session-related methods
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error
+	RevokeSession(ctx context.Context, id string) error
+	ReplaceSession(ctx context.Context, oldID string, session *models.Session) error
+	RevokeUserSessions(ctx context.Context, userID string) (int64, error)
+	DeleteExpiredSessions(ctx context.Context, idleBefore, expiredBefore time.Time) (int64, error)
+
+	// Ceremony-related methods
+	SaveCeremony(ctx context.Context, ceremony *models.Ceremony) error
+	TakeCeremony(ctx context.Context, id string) (*models.Ceremony, error)
+	DeleteCeremony(ctx context.Context, id string) error
+	DeleteExpiredCeremonies(ctx context.Context, before time.Time) (int64, error)
+
+	// OpenID Connect-related methods
+	SaveSigningKey(ctx context.Context, key *models.SigningKey) error
+	ListSigningKeys(ctx context.Context) ([]models.SigningKey, error)
+	DeleteSigningKeys(ctx context.Context, before time.Time) (int64, error)
+	SaveAuthorizationCode(ctx context.Context, code *models.AuthorizationCode) error
+	ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*models.AuthorizationCode, error)
+	DeleteExpiredAuthorizationCodes(ctx context.Context, before time.Time) (int64, error)
+
+	// Server secret-related methods
+	GetOrCreateServerSecret(ctx context.Context, name string, value []byte) ([]byte, error)
 }
 
 var (
-	dburl      = os.Getenv("BLUEPRINT_DB_URL")
-	dbInstance *service
+	// ErrUserExists is returned when a username is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when changing a user that does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrCredentialNotFound is returned when a credential does not exist or belongs to another user
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrCredentialExists is returned when a credential ID is already registered
+	ErrCredentialExists = errors.New("credential already registered")
+	// ErrLastCredential is returned when deleting a user's only credential that is not suspended
+	ErrLastCredential = errors.New("cannot delete the last credential")
+	// ErrEmailTaken is returned when another user already verified an email address
+	ErrEmailTaken = errors.New("email address already in use")
+	// ErrEmailChanged is returned when verifying an address the user no longer has
+	ErrEmailChanged = errors.New("email address changed")
+	// ErrSessionRevoked is returned when replacing a session that is gone or already revoked
+	ErrSessionRevoked = errors.New("session revoked")
 )
 
-func New() Service {
+type service struct {
+	db  *dbConn
+	url string
+}
+
+var dbInstance *service
+
+// New connects to the configured database. postgres:// and postgresql://
+// URLs select PostgreSQL; anything else is treated as a SQLite file name or URI.
+func New(cfg config.DatabaseConfig) Service {
 	if dbInstance != nil {
 		return dbInstance
 	}
 
-	db, err := sql.Open("sqlite3", dburl)
+	d := sqliteDialect
+	if strings.HasPrefix(cfg.URL, "postgres://") || strings.HasPrefix(cfg.URL, "postgresql://") {
+		d = postgresDialect
+	}
+
+	db, err := sql.Open(d.driverName(), cfg.URL)
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 
 	dbInstance = &service{
-		db: db,
+		db:  &dbConn{DB: db, dialect: d},
+		url: cfg.URL,
 	}
 	return dbInstance
 }
 
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// redactedURL hides any password in the database URL before it is logged
+func redactedURL(dburl string) string {
+	u, err := url.Parse(dburl)
+	if err != nil || u.User == nil {
+		return dburl
+	}
+	return u.Redacted()
+}
+
 func (s *service) Close() error {
-	log.Printf("Disconnected from database: %s", dburl)
+	log.Printf("Disconnected from database: %s", redactedURL(s.url))
 	return s.db.Close()
 }
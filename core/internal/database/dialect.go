@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dialect captures the SQL differences between the supported backends.
+// Queries are written for SQLite, with ? placeholders, and translated here.
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+// driverName returns the database/sql driver used for the dialect
+func (d dialect) driverName() string {
+	if d == postgresDialect {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+// rebind rewrites ? placeholders into the dialect's native form
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var (
+	blobType      = regexp.MustCompile(`\bBLOB\b`)
+	timestampType = regexp.MustCompile(`\bTIMESTAMP\b`)
+)
+
+// ddl rewrites column types in a CREATE or ALTER statement for the dialect
+func (d dialect) ddl(statement string) string {
+	if d != postgresDialect {
+		return statement
+	}
+	statement = blobType.ReplaceAllString(statement, "BYTEA")
+	return timestampType.ReplaceAllString(statement, "TIMESTAMPTZ")
+}
+
+// dbConn is a *sql.DB that rebinds placeholders for its dialect
+type dbConn struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (c *dbConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.DB.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*txConn, error) {
+	tx, err := c.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &txConn{Tx: tx, dialect: c.dialect}, nil
+}
+
+// txConn is a *sql.Tx that rebinds placeholders for its dialect
+type txConn struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *txConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *txConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.QueryContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *txConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return t.Tx.QueryRowContext(ctx, t.dialect.rebind(query), args...)
+}
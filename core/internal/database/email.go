@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetUserEmail changes a user's email address, which then needs verifying.
+// An empty email removes the address.
+func (s *service) SetUserEmail(ctx context.Context, userID, email string) error {
+	var value any
+	if email != "" {
+		value = email
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?
+	`, value, userID)
+	return err
+}
+
+// VerifyUserEmail marks the user's address as verified, provided it is still
+// email. Returns ErrEmailChanged if the user has since changed it and
+// ErrEmailTaken if another user verified it first.
+func (s *service) VerifyUserEmail(ctx context.Context, userID, email string) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE users SET email_verified_at = ?
+		WHERE id = ? AND email = ? AND email_verified_at IS NULL
+	`, time.Now().UTC(), userID, email)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Verifying an already verified address is not an error
+		user, err := s.GetUserByEmail(ctx, email)
+		if err != nil {
+			return err
+		}
+		if user == nil || user.ID != userID {
+			return ErrEmailChanged
+		}
+	}
+	return nil
+}
+
+// CreateEmailLink records a magic link about to be sent
+func (s *service) CreateEmailLink(ctx context.Context, link *models.EmailLink) error {
+	link.ID = uuid.New().String()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO email_links (id, user_id, purpose, email, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, link.ID, link.UserID, link.Purpose, link.Email, link.CreatedAt.UTC(), link.ExpiresAt.UTC())
+	return err
+}
+
+// CountEmailLinks returns how many magic links a user was sent since the given time
+func (s *service) CountEmailLinks(ctx context.Context, userID string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM email_links WHERE user_id = ? AND created_at > ?
+	`, userID, since.UTC()).Scan(&n)
+	return n, err
+}
+
+// ConsumeEmailLink marks an unexpired, unused magic link as used and returns
+// it, or nil if there is no such link. A link can only ever be consumed once.
+func (s *service) ConsumeEmailLink(ctx context.Context, id string) (*models.EmailLink, error) {
+	now := time.Now().UTC()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE email_links SET used_at = ?
+		WHERE id = ? AND used_at IS NULL AND expires_at > ?
+	`, now, id, now)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	var link models.EmailLink
+	var usedAt sql.NullTime
+	err = s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, purpose, email, created_at, expires_at, used_at
+		FROM email_links WHERE id = ?
+	`, id).Scan(&link.ID, &link.UserID, &link.Purpose, &link.Email, &link.CreatedAt, &link.ExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		link.UsedAt = &usedAt.Time
+	}
+	return &link, nil
+}
+
+// DeleteExpiredEmailLinks removes magic links that expired before the given time
+func (s *service) DeleteExpiredEmailLinks(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM email_links WHERE expires_at <= ?
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,665 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// migration is a single, versioned schema change. Each migration runs in its
+// own transaction together with its schema_migrations bookkeeping.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *txConn) error
+	down    func(ctx context.Context, tx *txConn) error
+}
+
+// MigrationStatus describes a known migration and whether it has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// migrations lists every schema change in the order it must be applied.
+// Never edit or reorder a released migration; append a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users and credentials",
+		// IF NOT EXISTS lets databases created before migrations adopt this one
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS users (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				display_name TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);`,
+			`CREATE TABLE IF NOT EXISTS credentials (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				public_key BLOB NOT NULL,
+				credential_id BLOB NOT NULL,
+				sign_count INTEGER NOT NULL,
+				aaguid BLOB,
+				clone_warning BOOLEAN NOT NULL DEFAULT false,
+				attachment TEXT,
+				backup_eligible BOOLEAN NOT NULL DEFAULT false,
+				backup_state BOOLEAN NOT NULL DEFAULT false,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			);`,
+		),
+		down: execAll(
+			`DROP TABLE credentials;`,
+			`DROP TABLE users;`,
+		),
+	},
+	{
+		version: 2,
+		name:    "create ceremonies",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS ceremonies (
+				id TEXT PRIMARY KEY,
+				data BLOB NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);`,
+		),
+		down: execAll(
+			`DROP TABLE ceremonies;`,
+		),
+	},
+	{
+		version: 3,
+		name:    "create sessions",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				last_seen_at TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);`,
+		),
+		down: execAll(
+			`DROP TABLE sessions;`,
+		),
+	},
+	{
+		version: 4,
+		name:    "add credential nickname and last use",
+		up: func(ctx context.Context, tx *txConn) error {
+			if err := addColumn(ctx, tx, "credentials", "nickname", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return addColumn(ctx, tx, "credentials", "last_used_at", "TIMESTAMP")
+		},
+		down: execAll(
+			`ALTER TABLE credentials DROP COLUMN last_used_at;`,
+			`ALTER TABLE credentials DROP COLUMN nickname;`,
+		),
+	},
+	{
+		version: 5,
+		name:    "make usernames unique",
+		up: func(ctx context.Context, tx *txConn) error {
+			if err := dedupeUsernames(ctx, tx); err != nil {
+				return err
+			}
+			return execAll(
+				`CREATE UNIQUE INDEX IF NOT EXISTS users_name ON users (name);`,
+			)(ctx, tx)
+		},
+		down: execAll(
+			`DROP INDEX users_name;`,
+		),
+	},
+	{
+		version: 6,
+		name:    "create signing keys and authorization codes",
+		up: execAll(
+			`CREATE TABLE signing_keys (
+				id TEXT PRIMARY KEY,
+				private_key BLOB NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);`,
+			`CREATE TABLE authorization_codes (
+				code_hash TEXT PRIMARY KEY,
+				client_id TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				redirect_uri TEXT NOT NULL,
+				scope TEXT NOT NULL,
+				nonce TEXT NOT NULL,
+				code_challenge TEXT NOT NULL,
+				auth_time TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			);`,
+		),
+		down: execAll(
+			`DROP TABLE authorization_codes;`,
+			`DROP TABLE signing_keys;`,
+		),
+	},
+	{
+		version: 7,
+		name:    "record authenticator flags",
+		// Existing rows keep flags_recorded false: their backup_eligible was
+		// guessed rather than taken from the authenticator
+		up: func(ctx context.Context, tx *txConn) error {
+			for _, column := range []string{"user_present", "user_verified", "flags_recorded"} {
+				if err := addColumn(ctx, tx, "credentials", column, "BOOLEAN NOT NULL DEFAULT false"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: execAll(
+			`ALTER TABLE credentials DROP COLUMN flags_recorded;`,
+			`ALTER TABLE credentials DROP COLUMN user_verified;`,
+			`ALTER TABLE credentials DROP COLUMN user_present;`,
+		),
+	},
+	{
+		version: 8,
+		name:    "add credential suspension and clone events",
+		up: func(ctx context.Context, tx *txConn) error {
+			if err := addColumn(ctx, tx, "credentials", "suspended_at", "TIMESTAMP"); err != nil {
+				return err
+			}
+			return execAll(
+				`CREATE TABLE clone_events (
+					id TEXT PRIMARY KEY,
+					credential_id TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					sign_count INTEGER NOT NULL,
+					action TEXT NOT NULL,
+					created_at TIMESTAMP NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				);`,
+				`CREATE INDEX clone_events_credential_id ON clone_events (credential_id);`,
+			)(ctx, tx)
+		},
+		down: execAll(
+			`DROP TABLE clone_events;`,
+			`ALTER TABLE credentials DROP COLUMN suspended_at;`,
+		),
+	},
+	{
+		version: 9,
+		name:    "record authenticator transports",
+		// Comma-separated; empty for credentials registered before this
+		up: func(ctx context.Context, tx *txConn) error {
+			return addColumn(ctx, tx, "credentials", "transports", "TEXT NOT NULL DEFAULT ''")
+		},
+		down: execAll(
+			`ALTER TABLE credentials DROP COLUMN transports;`,
+		),
+	},
+	{
+		version: 10,
+		name:    "add recovery codes and session scopes",
+		up: func(ctx context.Context, tx *txConn) error {
+			// Empty scope means a full session
+			if err := addColumn(ctx, tx, "sessions", "scope", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return execAll(
+				`CREATE TABLE recovery_codes (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					code_hash TEXT NOT NULL UNIQUE,
+					created_at TIMESTAMP NOT NULL,
+					used_at TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				);`,
+				`CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id);`,
+			)(ctx, tx)
+		},
+		down: execAll(
+			`DROP TABLE recovery_codes;`,
+			`ALTER TABLE sessions DROP COLUMN scope;`,
+		),
+	},
+	{
+		version: 11,
+		name:    "add user email and email links",
+		up: func(ctx context.Context, tx *txConn) error {
+			if err := addColumn(ctx, tx, "users", "email", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumn(ctx, tx, "users", "email_verified_at", "TIMESTAMP"); err != nil {
+				return err
+			}
+			return execAll(
+				// Only one account can prove it owns an address
+				`CREATE UNIQUE INDEX users_verified_email ON users (email) WHERE email_verified_at IS NOT NULL;`,
+				`CREATE TABLE email_links (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					purpose TEXT NOT NULL,
+					email TEXT NOT NULL,
+					created_at TIMESTAMP NOT NULL,
+					expires_at TIMESTAMP NOT NULL,
+					used_at TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				);`,
+				`CREATE INDEX email_links_user_id_created_at ON email_links (user_id, created_at);`,
+			)(ctx, tx)
+		},
+		down: execAll(
+			`DROP TABLE email_links;`,
+			`DROP INDEX users_verified_email;`,
+			`ALTER TABLE users DROP COLUMN email_verified_at;`,
+			`ALTER TABLE users DROP COLUMN email;`,
+		),
+	},
+	{
+		version: 12,
+		name:    "add audit events",
+		// No foreign key, so the history outlives the user and can name
+		// accounts that never existed
+		up: execAll(
+			`CREATE TABLE audit_events (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL DEFAULT '',
+				type TEXT NOT NULL,
+				credential_id TEXT NOT NULL DEFAULT '',
+				aaguid BLOB,
+				ip TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NOT NULL DEFAULT '',
+				details TEXT NOT NULL DEFAULT '{}',
+				created_at TIMESTAMP NOT NULL
+			);`,
+			`CREATE INDEX audit_events_user_id_created_at ON audit_events (user_id, created_at);`,
+			`CREATE INDEX audit_events_created_at ON audit_events (created_at);`,
+		),
+		down: execAll(
+			`DROP TABLE audit_events;`,
+		),
+	},
+	{
+		version: 13,
+		name:    "add rate limits",
+		// tat is the bucket's theoretical arrival time in Unix nanoseconds;
+		// integers keep the arithmetic the same in every dialect
+		up: execAll(
+			`CREATE TABLE rate_limits (
+				bucket TEXT PRIMARY KEY,
+				tat BIGINT NOT NULL
+			);`,
+		),
+		down: execAll(
+			`DROP TABLE rate_limits;`,
+		),
+	},
+	{
+		version: 14,
+		name:    "add user roles and disabled accounts",
+		up: func(ctx context.Context, tx *txConn) error {
+			// Empty role means a regular user
+			if err := addColumn(ctx, tx, "users", "role", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return addColumn(ctx, tx, "users", "disabled_at", "TIMESTAMP")
+		},
+		down: execAll(
+			`ALTER TABLE users DROP COLUMN disabled_at;`,
+			`ALTER TABLE users DROP COLUMN role;`,
+		),
+	},
+	{
+		version: 15,
+		name:    "make credential IDs unique",
+		up: func(ctx context.Context, tx *txConn) error {
+			// Which account really owns a duplicated credential cannot be
+			// told from the database, so an operator has to decide
+			rows, err := tx.QueryContext(ctx, `
+				SELECT id FROM credentials
+				WHERE credential_id IN (SELECT credential_id FROM credentials GROUP BY credential_id HAVING COUNT(*) > 1)
+				ORDER BY credential_id, created_at
+			`)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			var duplicates []string
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					return err
+				}
+				duplicates = append(duplicates, id)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if len(duplicates) > 0 {
+				return fmt.Errorf("credentials %s share a credential ID; delete all but one of each before migrating", strings.Join(duplicates, ", "))
+			}
+
+			return execAll(
+				`CREATE UNIQUE INDEX credentials_credential_id ON credentials (credential_id);`,
+			)(ctx, tx)
+		},
+		down: execAll(
+			`DROP INDEX credentials_credential_id;`,
+		),
+	},
+	{
+		version: 16,
+		name:    "create server secrets",
+		up: execAll(
+			`CREATE TABLE server_secrets (
+				name TEXT PRIMARY KEY,
+				value BLOB NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);`,
+		),
+		down: execAll(
+			`DROP TABLE server_secrets;`,
+		),
+	},
+	{
+		version: 17,
+		name:    "discard unkeyed recovery code hashes",
+		// Plain SHA-256 hashes cannot be rekeyed without the codes, so their
+		// owners are left without codes until they generate new ones
+		up: execAll(
+			`DELETE FROM recovery_codes;`,
+		),
+		down: execAll(),
+	},
+}
+
+// execAll returns a migration step running the statements in order, with
+// column types adjusted for the database's dialect
+func execAll(statements ...string) func(ctx context.Context, tx *txConn) error {
+	return func(ctx context.Context, tx *txConn) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, tx.dialect.ddl(statement)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column unless the table already has it, which is the case
+// for databases created by CreateTables before migrations existed
+func addColumn(ctx context.Context, tx *txConn, table, column, definition string) error {
+	if tx.dialect == postgresDialect {
+		_, err := tx.ExecContext(ctx, tx.dialect.ddl(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;`, table, column, definition)))
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	return err
+}
+
+// dedupeUsernames prepares databases from before names were unique, where
+// abandoned and racing sign-ups left several users with one name. Duplicates
+// without credentials never finished registering and are deleted. Of the
+// rest the oldest keeps the name and the others get a numeric suffix.
+func dedupeUsernames(ctx context.Context, tx *txConn) error {
+	type duplicate struct {
+		id, name       string
+		hasCredentials bool
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, name, EXISTS (SELECT 1 FROM credentials WHERE credentials.user_id = users.id)
+		FROM users
+		WHERE name IN (SELECT name FROM users GROUP BY name HAVING COUNT(*) > 1)
+		ORDER BY name, 3 DESC, created_at, id
+	`)
+	if err != nil {
+		return err
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.name, &d.hasCredentials); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, d := range duplicates {
+		if i == 0 || duplicates[i-1].name != d.name {
+			continue // first of its name keeps it
+		}
+
+		if !d.hasCredentials {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, d.id); err != nil {
+				return err
+			}
+			log.Printf("Deleted user %s, an unfinished sign-up duplicating the name %q", d.id, d.name)
+			continue
+		}
+
+		var renamed string
+		for n := 2; ; n++ {
+			renamed = fmt.Sprintf("%s-%d", d.name, n)
+			var taken int
+			err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE name = ?`, renamed).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken == 0 {
+				break
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET name = ? WHERE id = ?`, renamed, d.id); err != nil {
+			return err
+		}
+		log.Printf("Renamed user %s from %q to %q, as the name was taken", d.id, d.name, renamed)
+	}
+	return nil
+}
+
+// migrationLock keys the PostgreSQL advisory lock held while the schema
+// changes, "whodis" in ASCII
+const migrationLock = 0x77686f646973
+
+// lockMigrations makes other processes wait until the transaction ends before
+// they change the schema, so replicas starting together against one database
+// do not apply the same migration twice
+func lockMigrations(ctx context.Context, tx *txConn) error {
+	var err error
+	if tx.dialect == postgresDialect {
+		_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(?)`, migrationLock)
+	} else {
+		// SQLite takes its write lock on the first write rather than on reads
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version IS NULL`)
+	}
+	return err
+}
+
+// lockedSchemaVersion takes the migration lock and returns the schema version
+// as other processes left it
+func lockedSchemaVersion(ctx context.Context, tx *txConn) (int, error) {
+	if err := lockMigrations(ctx, tx); err != nil {
+		return 0, err
+	}
+	var version int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) FROM schema_migrations
+	`).Scan(&version)
+	return version, err
+}
+
+func (s *service) createMigrationsTable(ctx context.Context) error {
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		// Concurrent CREATE TABLE IF NOT EXISTS can still collide on PostgreSQL
+		if tx.dialect == postgresDialect {
+			if err := lockMigrations(ctx, tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, tx.dialect.ddl(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);`))
+		return err
+	})
+}
+
+// SchemaVersion returns the version of the newest applied migration, 0 if none
+func (s *service) SchemaVersion(ctx context.Context) (int, error) {
+	if err := s.createMigrationsTable(ctx); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) FROM schema_migrations
+	`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies every pending migration
+func (s *service) Migrate(ctx context.Context) error {
+	return s.MigrateTo(ctx, migrations[len(migrations)-1].version)
+}
+
+// MigrateTo applies or reverts migrations until the schema is at the target
+// version. Target 0 reverts everything.
+func (s *service) MigrateTo(ctx context.Context, target int) error {
+	if target < 0 || target > migrations[len(migrations)-1].version {
+		return fmt.Errorf("unknown schema version %d", target)
+	}
+
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Apply pending migrations oldest first. Each step checks the version
+	// again under the lock, as another process may have got there first.
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		applied := false
+		err := s.withTransaction(ctx, func(tx *txConn) error {
+			version, err := lockedSchemaVersion(ctx, tx)
+			if err != nil || version >= m.version {
+				return err
+			}
+			if err := m.up(ctx, tx); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)
+			`, m.version, m.name, time.Now().UTC())
+			applied = err == nil
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if applied {
+			log.Printf("Applied migration %d: %s", m.version, m.name)
+		}
+	}
+
+	// Revert newer migrations newest first
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		reverted := false
+		err := s.withTransaction(ctx, func(tx *txConn) error {
+			version, err := lockedSchemaVersion(ctx, tx)
+			if err != nil || version != m.version {
+				return err
+			}
+			if err := m.down(ctx, tx); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				DELETE FROM schema_migrations WHERE version = ?
+			`, m.version)
+			reverted = err == nil
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %w", m.version, m.name, err)
+		}
+		if reverted {
+			log.Printf("Reverted migration %d: %s", m.version, m.name)
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus lists every known migration and when it was applied
+func (s *service) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if err := s.createMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Version: m.version, Name: m.name}
+		if appliedAt, ok := applied[m.version]; ok {
+			status[i].AppliedAt = &appliedAt
+		}
+	}
+	return status, nil
+}
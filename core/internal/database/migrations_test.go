@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// legacySchema is what CreateTables created before migrations existed
+const legacySchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	display_name TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS credentials (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	public_key BLOB NOT NULL,
+	credential_id BLOB NOT NULL,
+	sign_count INTEGER NOT NULL,
+	aaguid BLOB,
+	clone_warning BOOLEAN NOT NULL DEFAULT false,
+	attachment TEXT,
+	backup_eligible BOOLEAN NOT NULL DEFAULT false,
+	backup_state BOOLEAN NOT NULL DEFAULT false,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);`
+
+// openSQLite returns a service on a fresh SQLite file
+func openSQLite(t *testing.T) *service {
+	t.Helper()
+
+	url := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &service{db: &dbConn{DB: db, dialect: sqliteDialect}, url: url}
+}
+
+// headVersion is the version of the newest migration
+func headVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// requireHead fails the test unless every migration is applied
+func requireHead(t *testing.T, s *service) {
+	t.Helper()
+
+	version, err := s.SchemaVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != headVersion() {
+		t.Fatalf("schema version = %d, want %d", version, headVersion())
+	}
+
+	status, err := s.MigrationStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			t.Errorf("migration %d (%s) not applied", m.Version, m.Name)
+		}
+	}
+}
+
+// userTables lists the tables besides the migration bookkeeping
+func userTables(t *testing.T, s *service) []string {
+	t.Helper()
+
+	rows, err := s.db.QueryContext(context.Background(), `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')
+		ORDER BY name
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	ctx := context.Background()
+	s := openSQLite(t)
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requireHead(t, s)
+
+	// Migrating again is a no-op
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requireHead(t, s)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	ctx := context.Background()
+	s := openSQLite(t)
+
+	if _, err := s.db.ExecContext(ctx, legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	// Legacy databases hold duplicate names: an abandoned sign-up, which has
+	// no credential, and two finished ones
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (id, name, display_name, created_at) VALUES
+			('abandoned', 'bob', 'Bob', '2024-01-01 00:00:00'),
+			('first', 'bob', 'Bob', '2024-01-02 00:00:00'),
+			('second', 'bob', 'Bob', '2024-01-03 00:00:00'),
+			('taken', 'bob-2', 'Bob', '2024-01-04 00:00:00');
+		INSERT INTO credentials (id, user_id, public_key, credential_id, sign_count, aaguid, attachment) VALUES
+			('c1', 'first', x'01', x'a1', 3, x'00', 'platform'),
+			('c2', 'second', x'01', x'a2', 0, x'00', ''),
+			('c3', 'taken', x'01', x'a3', 0, x'00', '');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requireHead(t, s)
+
+	for name, want := range map[string]string{"bob": "first", "bob-2": "taken", "bob-3": "second"} {
+		user, err := s.GetUserByName(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user == nil || user.ID != want {
+			t.Errorf("user %q = %+v, want ID %s", name, user, want)
+		}
+	}
+	if user, err := s.GetUserByID(ctx, "abandoned"); err != nil || user != nil {
+		t.Errorf("abandoned sign-up = %+v, %v, want deleted", user, err)
+	}
+
+	// Existing credentials keep working under the new columns
+	credential, err := s.GetCredential(ctx, []byte{0xa1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential == nil || credential.UserID != "first" || credential.SignCount != 3 {
+		t.Errorf("credential = %+v, want the one of user first with sign count 3", credential)
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	ctx := context.Background()
+	s := openSQLite(t)
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MigrateTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("schema version = %d after reverting everything, want 0", version)
+	}
+	if tables := userTables(t, s); len(tables) > 0 {
+		t.Errorf("tables %v left after reverting everything", tables)
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requireHead(t, s)
+}
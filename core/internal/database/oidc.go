@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"time"
+)
+
+// SaveSigningKey stores a new token signing key
+func (s *service) SaveSigningKey(ctx context.Context, key *models.SigningKey) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO signing_keys (id, private_key, created_at) VALUES (?, ?, ?)
+	`, key.ID, key.PrivateKey, key.CreatedAt.UTC())
+	return err
+}
+
+// ListSigningKeys retrieves every signing key, newest first
+func (s *service) ListSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, private_key, created_at FROM signing_keys ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.SigningKey
+	for rows.Next() {
+		var key models.SigningKey
+		if err := rows.Scan(&key.ID, &key.PrivateKey, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteSigningKeys removes keys created before the given time, once no
+// token signed by them can still be valid
+func (s *service) DeleteSigningKeys(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM signing_keys WHERE created_at < ?
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SaveAuthorizationCode stores an issued authorization code
+func (s *service) SaveAuthorizationCode(ctx context.Context, code *models.AuthorizationCode) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO authorization_codes (
+			code_hash,
+			client_id,
+			user_id,
+			redirect_uri,
+			scope,
+			nonce,
+			code_challenge,
+			auth_time,
+			expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		code.CodeHash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		code.Scope,
+		code.Nonce,
+		code.CodeChallenge,
+		code.AuthTime.UTC(),
+		code.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// ConsumeAuthorizationCode retrieves an unexpired authorization code and
+// deletes it, so each code can be exchanged only once
+func (s *service) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*models.AuthorizationCode, error) {
+	var code models.AuthorizationCode
+	err := s.withTransaction(ctx, func(tx *txConn) error {
+		err := tx.QueryRowContext(ctx, `
+			SELECT
+				code_hash,
+				client_id,
+				user_id,
+				redirect_uri,
+				scope,
+				nonce,
+				code_challenge,
+				auth_time,
+				expires_at
+			FROM authorization_codes
+			WHERE code_hash = ?
+		`, codeHash).Scan(
+			&code.CodeHash,
+			&code.ClientID,
+			&code.UserID,
+			&code.RedirectURI,
+			&code.Scope,
+			&code.Nonce,
+			&code.CodeChallenge,
+			&code.AuthTime,
+			&code.ExpiresAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			DELETE FROM authorization_codes WHERE code_hash = ?
+		`, codeHash)
+		if err != nil {
+			return err
+		}
+		// Another request consumed the code first
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Code not found or already used
+		}
+		return nil, err
+	}
+	if !code.ExpiresAt.After(time.Now()) {
+		return nil, nil // Code expired
+	}
+	return &code, nil
+}
+
+// DeleteExpiredAuthorizationCodes removes codes that expired before the given time
+func (s *service) DeleteExpiredAuthorizationCodes(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM authorization_codes WHERE expires_at <= ?
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
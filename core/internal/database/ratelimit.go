@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"core/internal/config"
+)
+
+// errRateLimited rolls back a TakeRateLimits transaction once a bucket refuses
+var errRateLimited = errors.New("rate limited")
+
+// TakeRateLimits spends a request from every bucket, or from none if any of
+// them is empty. Each bucket holds Burst requests and is refilled at one per
+// Interval, using the generic cell rate algorithm. It returns the longest
+// wait until the request would be allowed, and 0 once it has been counted.
+func (s *service) TakeRateLimits(ctx context.Context, buckets map[string]config.RateLimit, now time.Time) (time.Duration, error) {
+	// Taking rows in a fixed order keeps concurrent requests from deadlocking
+	names := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+
+	var longest time.Duration
+	err := s.withTransaction(ctx, func(tx *txConn) error {
+		for _, bucket := range names {
+			wait, err := takeRateLimit(ctx, tx, bucket, now, buckets[bucket])
+			if err != nil {
+				return err
+			}
+			longest = max(longest, wait)
+		}
+		if longest > 0 {
+			return errRateLimited
+		}
+		return nil
+	})
+	if errors.Is(err, errRateLimited) {
+		return longest, nil
+	}
+	return 0, err
+}
+
+// takeRateLimit spends a request from one bucket as part of tx, returning how
+// long to wait if it is empty
+func takeRateLimit(ctx context.Context, tx *txConn, bucket string, now time.Time, limit config.RateLimit) (time.Duration, error) {
+	nowNano := now.UnixNano()
+	slack := int64(limit.Burst-1) * int64(limit.Interval)
+
+	// A missing bucket is full, as is one whose arrival time has passed
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO rate_limits (bucket, tat) VALUES (?, ?)
+		ON CONFLICT (bucket) DO NOTHING
+	`, bucket, nowNano)
+	if err != nil {
+		return 0, err
+	}
+
+	// Checking and spending in one statement keeps concurrent requests from
+	// both taking the last token
+	result, err := tx.ExecContext(ctx, `
+		UPDATE rate_limits
+		SET tat = CASE WHEN tat > ? THEN tat ELSE ? END + ?
+		WHERE bucket = ? AND CASE WHEN tat > ? THEN tat ELSE ? END - ? <= ?
+	`, nowNano, nowNano, int64(limit.Interval), bucket, nowNano, nowNano, nowNano, slack)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, nil
+	}
+
+	var tat int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT tat FROM rate_limits WHERE bucket = ?
+	`, bucket).Scan(&tat)
+	if err == sql.ErrNoRows {
+		return 0, nil // swept in between, so full again
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(tat - nowNano - slack), nil
+}
+
+// DeleteExpiredRateLimits removes every bucket that had refilled by the given
+// time, which is the same as not having one
+func (s *service) DeleteExpiredRateLimits(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM rate_limits WHERE tat <= ?
+	`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReplaceRecoveryCodes discards a user's recovery codes, used or not, and
+// stores new ones
+func (s *service) ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+		return insertRecoveryCodes(ctx, tx, userID, codeHashes)
+	})
+}
+
+func insertRecoveryCodes(ctx context.Context, ex execer, userID string, codeHashes []string) error {
+	now := time.Now().UTC()
+	for _, hash := range codeHashes {
+		_, err := ex.ExecContext(ctx, `
+			INSERT INTO recovery_codes (id, user_id, code_hash, created_at)
+			VALUES (?, ?, ?, ?)
+		`, uuid.New().String(), userID, hash, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code of the user as used and
+// reports whether there was one. A code can only ever be consumed once, even
+// by concurrent requests.
+func (s *service) ConsumeRecoveryCode(ctx context.Context, userID, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().UTC(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (s *service) CountRecoveryCodes(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL
+	`, userID).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// GetOrCreateServerSecret returns the secret stored under name, storing
+// value first if there is none. Replicas racing to create the same secret
+// all get the one that was stored first.
+func (s *service) GetOrCreateServerSecret(ctx context.Context, name string, value []byte) ([]byte, error) {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO server_secrets (name, value, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO NOTHING
+	`, name, value, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []byte
+	err = s.db.QueryRowContext(ctx, `SELECT value FROM server_secrets WHERE name = ?`, name).Scan(&stored)
+	return stored, err
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"core/internal/models"
+	"database/sql"
+	"time"
+)
+
+// CreateSession saves a new authenticated session
+func (s *service) CreateSession(ctx context.Context, session *models.Session) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at, scope)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`,
+		session.ID,
+		session.UserID,
+		session.CreatedAt.UTC(),
+		session.LastSeenAt.UTC(),
+		session.ExpiresAt.UTC(),
+		session.Scope,
+	)
+	return err
+}
+
+// GetSession retrieves a session by its ID, including revoked and expired ones
+func (s *service) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	var session models.Session
+	var revokedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, created_at, last_seen_at, expires_at, revoked_at, scope
+		FROM sessions WHERE id = ?
+	`, id).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.ExpiresAt,
+		&revokedAt,
+		&session.Scope,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Session not found
+		}
+		return nil, err
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+// TouchSession records activity on a session
+func (s *service) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET last_seen_at = ? WHERE id = ?
+	`, lastSeenAt.UTC(), id)
+	return err
+}
+
+// RevokeSession marks a single session as revoked
+func (s *service) RevokeSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), id)
+	return err
+}
+
+// ReplaceSession revokes the session oldID and saves session in its place,
+// in one transaction. It returns ErrSessionRevoked if oldID was gone or
+// already revoked, so of concurrent replacements at most one succeeds.
+func (s *service) ReplaceSession(ctx context.Context, oldID string, session *models.Session) error {
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL
+		`, time.Now().UTC(), oldID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n != 1 {
+			return ErrSessionRevoked
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at, scope)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`,
+			session.ID,
+			session.UserID,
+			session.CreatedAt.UTC(),
+			session.LastSeenAt.UTC(),
+			session.ExpiresAt.UTC(),
+			session.Scope,
+		)
+		return err
+	})
+}
+
+// RevokeUserSessions marks every active session of a user as revoked
+func (s *service) RevokeUserSessions(ctx context.Context, userID string) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions removes sessions that can no longer be used
+func (s *service) DeleteExpiredSessions(ctx context.Context, idleBefore, expiredBefore time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE expires_at <= ? OR last_seen_at <= ? OR revoked_at IS NOT NULL
+	`, expiredBefore.UTC(), idleBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -7,7 +7,13 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func (s *service) withTransaction(ctx context.Context, fn func(*sql.Tx) error) error {
+// execer is implemented by both dbConn and txConn, so statements can run
+// either on their own or as part of a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *service) withTransaction(ctx context.Context, fn func(*txConn) error) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
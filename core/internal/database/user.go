@@ -5,41 +5,41 @@ import (
 	"core/internal/models"
 	"database/sql"
 	"log"
+	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 )
 
-// GetUserByID retrieves a user by their ID
-func (s *service) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+// userColumns lists the users columns read by scanUser
+const userColumns = `users.id, users.name, users.display_name, users.email, users.email_verified_at,
+	users.role, users.disabled_at, users.created_at`
+
+// scanUser reads a row of userColumns
+func scanUser(row interface{ Scan(...any) error }) (*models.User, error) {
 	var user models.User
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name, display_name FROM users WHERE id = ?
-	`, id).Scan(&user.ID, &user.Name, &user.DisplayName)
+	var email sql.NullString
+	var emailVerified, disabled, created sql.NullTime
+	err := row.Scan(&user.ID, &user.Name, &user.DisplayName, &email, &emailVerified, &user.Role, &disabled, &created)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil // User not found
-		}
 		return nil, err
 	}
-
-	// Load user's credentials
-	credentials, err := s.GetCredentialsForUser(ctx, user.ID)
-	if err != nil {
-		return nil, err
+	user.Email = email.String
+	if emailVerified.Valid {
+		user.EmailVerified = &emailVerified.Time
 	}
-	user.Credentials = credentials
-
+	if disabled.Valid {
+		user.DisabledAt = &disabled.Time
+	}
+	user.CreatedAt = created.Time
 	return &user, nil
 }
 
-// GetUserByName retrieves a user by their username
-func (s *service) GetUserByName(ctx context.Context, name string) (*models.User, error) {
-	var user models.User
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name, display_name FROM users WHERE name = ?
-	`, name).Scan(&user.ID, &user.Name, &user.DisplayName)
+// getUser returns the user selected by a query over userColumns, with
+// their credentials loaded
+func (s *service) getUser(ctx context.Context, query string, args ...any) (*models.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, query, args...))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // User not found
@@ -54,37 +54,79 @@ func (s *service) GetUserByName(ctx context.Context, name string) (*models.User,
 	}
 	user.Credentials = credentials
 
-	return &user, nil
+	return user, nil
+}
+
+// GetUserByID retrieves a user by their ID
+func (s *service) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	return s.getUser(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+}
+
+// GetUserByName retrieves a user by their username
+func (s *service) GetUserByName(ctx context.Context, name string) (*models.User, error) {
+	return s.getUser(ctx, `SELECT `+userColumns+` FROM users WHERE name = ?`, name)
+}
+
+// GetUserByEmail retrieves the user who verified the given address
+func (s *service) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return s.getUser(ctx, `
+		SELECT `+userColumns+` FROM users
+		WHERE email = ? AND email_verified_at IS NOT NULL
+	`, email)
+}
+
+// GetUserByCredentialID retrieves the user owning the given WebAuthn credential
+func (s *service) GetUserByCredentialID(ctx context.Context, credentialID []byte) (*models.User, error) {
+	return s.getUser(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		JOIN credentials ON credentials.user_id = users.id
+		WHERE credentials.credential_id = ?
+	`, credentialID)
 }
 
 // SaveUser saves a new user to the database
 func (s *service) SaveUser(ctx context.Context, user *models.User) error {
-	_, err := s.db.ExecContext(ctx, `
+	return insertUser(ctx, s.db, user)
+}
+
+// CreateUserWithCredential saves a new user together with their first
+// credential and recovery codes, so a user never exists without a way to
+// log in
+func (s *service) CreateUserWithCredential(ctx context.Context, user *models.User, credential *models.Credential, recoveryCodeHashes []string) error {
+	return s.withTransaction(ctx, func(tx *txConn) error {
+		if err := insertUser(ctx, tx, user); err != nil {
+			return err
+		}
+
+		credential.UserID = user.ID
+
+		if err := insertCredential(ctx, tx, credential); err != nil {
+			return err
+		}
+		return insertRecoveryCodes(ctx, tx, user.ID, recoveryCodeHashes)
+	})
+}
+
+func insertUser(ctx context.Context, ex execer, user *models.User) error {
+	_, err := ex.ExecContext(ctx, `
 		INSERT INTO users (id, name, display_name) VALUES (?, ?, ?)
 	`, user.ID, user.Name, user.DisplayName)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
 	return err
 }
 
 // SaveCredential saves a new credential to the database
 func (s *service) SaveCredential(ctx context.Context, credential *models.Credential) error {
-	// Check if the user has any backup-eligible credentials
-	existingCreds, err := s.GetCredentialsForUser(ctx, credential.UserID)
-	if err != nil {
-		return err
-	}
-
-	if len(existingCreds) == 0 {
-		credential.BackupEligible = true
-	} else {
-		credential.BackupEligible = false
-	}
+	return insertCredential(ctx, s.db, credential)
+}
 
+func insertCredential(ctx context.Context, ex execer, credential *models.Credential) error {
 	recordID := uuid.New().String()
 
-	// Log the credential being saved
-	log.Printf("Saving credential: %+v", credential)
-
-	_, err = s.db.ExecContext(ctx, `
+	_, err := ex.ExecContext(ctx, `
 		INSERT INTO credentials (
 			id,
 			user_id,
@@ -94,9 +136,13 @@ func (s *service) SaveCredential(ctx context.Context, credential *models.Credent
 			aaguid,
 			clone_warning,
 			attachment,
+			transports,
+			user_present,
+			user_verified,
 			backup_eligible,
-			backup_state
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			backup_state,
+			flags_recorded
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`,
 		recordID,
 		credential.UserID,
@@ -106,14 +152,22 @@ func (s *service) SaveCredential(ctx context.Context, credential *models.Credent
 		credential.AAGUID,
 		credential.CloneWarning,
 		string(credential.Attachment),
+		joinTransports(credential.Transports),
+		credential.UserPresent,
+		credential.UserVerified,
 		credential.BackupEligible,
 		credential.BackupState,
+		true,
 	)
 
+	if isUniqueViolation(err) {
+		return ErrCredentialExists
+	}
 	if err != nil {
 		log.Printf("Error saving credential: %v", err)
 		return err
 	}
+	credential.ID = recordID
 
 	log.Printf("Successfully saved credential with ID: %s", recordID)
 	return nil
@@ -129,8 +183,12 @@ func (s *service) GetCredentialsForUser(ctx context.Context, userID string) ([]w
 			aaguid,
 			clone_warning,
 			attachment,
+			transports,
+			user_present,
+			user_verified,
 			backup_eligible,
-			backup_state
+			backup_state,
+			flags_recorded
 		FROM credentials
 		WHERE user_id = ?
 	`, userID)
@@ -142,7 +200,7 @@ func (s *service) GetCredentialsForUser(ctx context.Context, userID string) ([]w
 	var credentials []webauthn.Credential
 	for rows.Next() {
 		var cred models.Credential
-		var attachmentStr string
+		var attachmentStr, transports string
 		err := rows.Scan(
 			&cred.CredentialID,
 			&cred.PublicKey,
@@ -150,32 +208,51 @@ func (s *service) GetCredentialsForUser(ctx context.Context, userID string) ([]w
 			&cred.AAGUID,
 			&cred.CloneWarning,
 			&attachmentStr,
+			&transports,
+			&cred.UserPresent,
+			&cred.UserVerified,
 			&cred.BackupEligible,
 			&cred.BackupState,
+			&cred.FlagsRecorded,
 		)
 		if err != nil {
 			return nil, err
 		}
 		cred.UserID = userID
 		cred.Attachment = protocol.AuthenticatorAttachment(attachmentStr)
+		cred.Transports = splitTransports(transports)
 
-		// Log the credential details for debugging
-		log.Printf("Retrieved credential from DB: %+v", cred)
-
-		wanCred := cred.ToWebauthnCredential()
-		log.Printf("Converted to WebAuthn credential: %+v", wanCred)
-
-		credentials = append(credentials, wanCred)
+		credentials = append(credentials, cred.ToWebauthnCredential())
 	}
 	return credentials, rows.Err()
 }
 
-// UpdateCredentialSignCount updates the signCount for a given credential
-func (s *service) UpdateCredentialSignCount(ctx context.Context, credentialID []byte, signCount uint32) error {
+// UpdateCredentialAfterLogin records a successful login with the credential:
+// its new signCount, its current backup state and when it was used. Flags of
+// credentials stored before flags were recorded are taken from the login.
+// The stored signCount never moves backwards, even when logins race.
+func (s *service) UpdateCredentialAfterLogin(ctx context.Context, credentialID []byte, signCount uint32, flags webauthn.CredentialFlags) error {
 	_, err := s.db.ExecContext(ctx, `
 		UPDATE credentials
-		SET sign_count = ?
+		SET
+			sign_count = CASE WHEN sign_count < ? THEN ? ELSE sign_count END,
+			backup_state = ?,
+			last_used_at = ?,
+			user_present = CASE WHEN flags_recorded THEN user_present ELSE ? END,
+			user_verified = CASE WHEN flags_recorded THEN user_verified ELSE ? END,
+			backup_eligible = CASE WHEN flags_recorded THEN backup_eligible ELSE ? END,
+			flags_recorded = ?
 		WHERE credential_id = ?
-	`, signCount, credentialID)
+	`,
+		signCount,
+		signCount,
+		flags.BackupState,
+		time.Now().UTC(),
+		flags.UserPresent,
+		flags.UserVerified,
+		flags.BackupEligible,
+		true,
+		credentialID,
+	)
 	return err
 }
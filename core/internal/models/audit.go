@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// AuditEvent is an entry in the append-only log of security-relevant events
+type AuditEvent struct {
+	ID           string         // database record ID
+	UserID       string         // account the event concerns, empty if unknown
+	Type         string         // what happened, e.g. login_succeeded
+	CredentialID string         // database record ID of the credential involved, if any
+	AAGUID       []byte         // model of the authenticator involved, if any
+	IP           string         // client address of the request
+	UserAgent    string         // client User-Agent of the request
+	Details      map[string]any // event-specific fields
+	CreatedAt    time.Time      // when the event happened
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Ceremony is a persisted, in-flight WebAuthn ceremony
+type Ceremony struct {
+	ID        string    // opaque ceremony ID handed to the client
+	Data      []byte    // JSON-encoded ceremony state
+	ExpiresAt time.Time // after this the ceremony can no longer be finished
+}
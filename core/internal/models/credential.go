@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 )
@@ -15,8 +17,27 @@ type Credential struct {
 	AAGUID         []byte
 	CloneWarning   bool
 	Attachment     protocol.AuthenticatorAttachment
-	BackupEligible bool
-	BackupState    bool
+	Transports     []protocol.AuthenticatorTransport // reported by the client at registration
+	UserPresent    bool                              // UP flag at registration
+	UserVerified   bool                              // UV flag at registration
+	BackupEligible bool                              // BE flag, fixed for the credential's lifetime
+	BackupState    bool                              // BS flag as of the last login
+	FlagsRecorded  bool                              // false for credentials stored before flags were recorded
+	Nickname       string                            // user-chosen friendly name
+	CreatedAt      time.Time                         // when the credential was registered
+	LastUsedAt     *time.Time                        // last successful login, nil if never used
+	SuspendedAt    *time.Time                        // set when the credential looked cloned, nil while usable
+}
+
+// CloneEvent records a login whose signature counter suggested the
+// credential was cloned
+type CloneEvent struct {
+	ID           string    // database record ID
+	CredentialID string    // database record ID of the credential
+	UserID       string    // owner of the credential
+	SignCount    uint32    // stored counter the assertion failed to exceed
+	Action       string    // warn or suspend, as configured at the time
+	CreatedAt    time.Time // when the regression was detected
 }
 
 type CredentialFlags struct {
@@ -39,9 +60,10 @@ func (c *Credential) ToWebauthnCredential() webauthn.Credential {
 	return webauthn.Credential{
 		ID:        c.CredentialID,
 		PublicKey: c.PublicKey,
+		Transport: c.Transports,
 		Flags: webauthn.CredentialFlags{
-			UserPresent:    true,
-			UserVerified:   true,
+			UserPresent:    c.UserPresent,
+			UserVerified:   c.UserVerified,
 			BackupEligible: c.BackupEligible,
 			BackupState:    c.BackupState,
 		},
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// EmailLink is a magic link sent to a user's email address
+type EmailLink struct {
+	ID        string     // database record ID, also the token's jti
+	UserID    string     // user the link was sent to
+	Purpose   string     // verify_email or passkey_reset
+	Email     string     // address the link was sent to
+	CreatedAt time.Time  // when the link was issued
+	ExpiresAt time.Time  // when the link stops working
+	UsedAt    *time.Time // set once the link has been followed
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// SigningKey is a private key used to sign issued tokens
+type SigningKey struct {
+	ID         string    // key ID published as "kid" in the JWKS
+	PrivateKey []byte    // PKCS #8, DER encoded
+	CreatedAt  time.Time // newer keys take over signing from older ones
+}
+
+// AuthorizationCode is an OpenID Connect authorization code awaiting exchange
+type AuthorizationCode struct {
+	CodeHash      string    // SHA-256 of the code handed to the client, hex encoded
+	ClientID      string    // client the code was issued to
+	UserID        string    // user who authorized the client
+	RedirectURI   string    // must match again at the token endpoint
+	Scope         string    // granted scopes, space separated
+	Nonce         string    // echoed into the ID token
+	CodeChallenge string    // PKCE S256 challenge
+	AuthTime      time.Time // when the user logged in
+	ExpiresAt     time.Time // codes are short lived
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Session represents an authenticated user session
+type Session struct {
+	ID         string     // SHA-256 of the session token, hex encoded
+	UserID     string     // foreign key to users table
+	CreatedAt  time.Time  // when the session was established
+	LastSeenAt time.Time  // last authenticated request, drives the idle timeout
+	ExpiresAt  time.Time  // absolute expiry regardless of activity
+	RevokedAt  *time.Time // set once the session has been revoked
+	Scope      string     // empty for full access, "recovery" while only a passkey may be enrolled
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
@@ -9,9 +11,17 @@ type User struct {
     ID             string                 // Unique identifier for the user
     Name           string                 // Username
     DisplayName    string                 // Full name or display name
+    Email          string                 // Optional contact address, lowercased
+    EmailVerified  *time.Time             // When Email was verified, nil until then
+    Role           string                 // Empty for regular users, RoleAdmin for operators
+    DisabledAt     *time.Time             // When an operator disabled the account, nil while enabled
+    CreatedAt      time.Time              // When the account was registered
     Credentials    []webauthn.Credential  // WebAuthn credentials
 }
 
+// RoleAdmin lets a user manage other accounts through the /admin API
+const RoleAdmin = "admin"
+
 // Ensure User satisfies the webauthn.User interface
 var _ webauthn.User = &User{}
 
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"core/internal/database"
+	"core/internal/models"
+)
+
+const (
+	// defaultUserLimit is the page size of GET /admin/users
+	defaultUserLimit = 50
+	// maxUserLimit bounds the page size an administrator may ask for
+	maxUserLimit = 200
+)
+
+// AdminMiddleware admits only administrators. It runs after AuthMiddleware.
+func (s *Server) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r)
+		if user == nil || user.Role != models.RoleAdmin {
+			jsonError(w, r, http.StatusForbidden, codeForbidden, "Administrator role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminUserResponse is what administrators see of an account
+type adminUserResponse struct {
+	userResponse
+	Role       string     `json:"role,omitempty"`
+	DisabledAt *time.Time `json:"disabledAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func newAdminUserResponse(user *models.User) adminUserResponse {
+	return adminUserResponse{
+		userResponse: newUserResponse(user),
+		Role:         user.Role,
+		DisabledAt:   user.DisabledAt,
+		CreatedAt:    user.CreatedAt,
+	}
+}
+
+// sessionResponse describes a session without revealing its token
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Scope      string    `json:"scope,omitempty"`
+}
+
+// adminDetails records which administrator took an action in its audit event
+func adminDetails(r *http.Request, details map[string]any) map[string]any {
+	if details == nil {
+		details = make(map[string]any)
+	}
+	admin := userFromContext(r)
+	details["admin"] = admin.ID
+	details["adminName"] = admin.Name
+	return details
+}
+
+// adminTarget loads the user named by the id URL parameter. On failure it
+// writes the error response and returns nil.
+func (s *Server) adminTarget(w http.ResponseWriter, r *http.Request) *models.User {
+	user, err := s.db.GetUserByID(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to get user")
+		return nil
+	}
+	if user == nil {
+		jsonError(w, r, http.StatusNotFound, codeNotFound, "User not found")
+		return nil
+	}
+	return user
+}
+
+// AdminListUsers returns users ordered by name. The optional query parameter
+// matches part of the name, display name or email; cursor continues from the
+// nextCursor of the previous page.
+func (s *Server) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultUserLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUserLimit {
+			jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	users, err := s.db.ListUsers(r.Context(), database.UserFilter{
+		Query:  query.Get("query"),
+		Cursor: query.Get("cursor"),
+		// One more than a page tells whether there is a next one
+		Limit: limit + 1,
+	})
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list users")
+		return
+	}
+
+	response := struct {
+		Users      []adminUserResponse `json:"users"`
+		NextCursor string              `json:"nextCursor,omitempty"`
+	}{
+		Users: make([]adminUserResponse, 0, len(users)),
+	}
+	if len(users) > limit {
+		users = users[:limit]
+		response.NextCursor = users[limit-1].ID
+	}
+	for i := range users {
+		response.Users = append(response.Users, newAdminUserResponse(&users[i]))
+	}
+
+	jsonResponse(w, response)
+}
+
+// AdminGetUser returns an account with its credentials and active sessions
+func (s *Server) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+
+	credentials, err := s.db.ListCredentialsForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to list credentials: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list credentials")
+		return
+	}
+	sessions, err := s.db.ListUserSessions(r.Context(), user.ID, time.Now())
+	if err != nil {
+		log.Printf("Failed to list sessions: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list sessions")
+		return
+	}
+
+	response := struct {
+		User        adminUserResponse    `json:"user"`
+		Credentials []credentialResponse `json:"credentials"`
+		Sessions    []sessionResponse    `json:"sessions"`
+	}{
+		User:        newAdminUserResponse(user),
+		Credentials: make([]credentialResponse, 0, len(credentials)),
+		Sessions:    make([]sessionResponse, 0, len(sessions)),
+	}
+	for i := range credentials {
+		response.Credentials = append(response.Credentials, s.newCredentialResponse(&credentials[i]))
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, sessionResponse{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Scope:      session.Scope,
+		})
+	}
+
+	jsonResponse(w, response)
+}
+
+// AdminDisableUser blocks an account from logging in or recovering and ends
+// its sessions. Access tokens already handed out in token mode stay valid
+// elsewhere until they expire.
+func (s *Server) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+	if user.ID == userFromContext(r).ID {
+		jsonError(w, r, http.StatusConflict, codeSelfLockout, "Cannot disable your own account")
+		return
+	}
+
+	now := time.Now()
+	if err := s.db.SetUserDisabled(r.Context(), user.ID, &now); err != nil {
+		log.Printf("Failed to disable user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to disable user")
+		return
+	}
+	if err := s.sessions.RevokeAllForUser(r.Context(), user.ID); err != nil {
+		log.Printf("Failed to revoke sessions: %v", err)
+	}
+
+	log.Printf("Disabled user %s", user.ID)
+	s.audit(r, user.ID, auditAccountDisabled, adminDetails(r, nil))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminEnableUser lets a disabled account log in again
+func (s *Server) AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := s.db.SetUserDisabled(r.Context(), user.ID, nil); err != nil {
+		log.Printf("Failed to enable user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to enable user")
+		return
+	}
+
+	log.Printf("Enabled user %s", user.ID)
+	s.audit(r, user.ID, auditAccountEnabled, adminDetails(r, nil))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminDeleteCredential removes one of a user's credentials. Like users
+// themselves, administrators cannot remove the last one; disable the
+// account instead.
+func (s *Server) AdminDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+	id := chi.URLParam(r, "credentialID")
+
+	// Looked up first, as the audit log keeps the authenticator model
+	credential := s.auditedCredential(r, user.ID, id)
+
+	err := s.db.DeleteCredential(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrCredentialNotFound):
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+		case errors.Is(err, database.ErrLastCredential):
+			jsonError(w, r, http.StatusConflict, codeLastCredential, "Cannot delete the last usable credential")
+		default:
+			log.Printf("Failed to delete credential: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to delete credential")
+		}
+		return
+	}
+
+	log.Printf("Deleted credential %s for user %s", id, user.ID)
+	s.auditCredential(r, user.ID, auditCredentialRemoved, credential, adminDetails(r, nil))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminReinstateCredential lifts the clone warning and suspension of a
+// credential, for users who have no other passkey to do it themselves
+func (s *Server) AdminReinstateCredential(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+	id := chi.URLParam(r, "credentialID")
+
+	err := s.db.ReinstateCredential(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, database.ErrCredentialNotFound) {
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+			return
+		}
+		log.Printf("Failed to reinstate credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to reinstate credential")
+		return
+	}
+
+	log.Printf("Reinstated credential %s for user %s", id, user.ID)
+	s.auditCredential(r, user.ID, auditCredentialReinstated, s.auditedCredential(r, user.ID, id), adminDetails(r, nil))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminRevokeSession ends one of a user's sessions
+func (s *Server) AdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+	id := chi.URLParam(r, "sessionID")
+
+	session, err := s.db.GetSession(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to get session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to revoke session")
+		return
+	}
+	if session == nil || session.UserID != user.ID || session.RevokedAt != nil {
+		jsonError(w, r, http.StatusNotFound, codeNotFound, "Session not found")
+		return
+	}
+
+	if err := s.db.RevokeSession(r.Context(), id); err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to revoke session")
+		return
+	}
+
+	log.Printf("Revoked session of user %s", user.ID)
+	s.audit(r, user.ID, auditSessionRevoked, adminDetails(r, map[string]any{"reason": "admin"}))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminRevokeSessions logs a user out everywhere
+func (s *Server) AdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	user := s.adminTarget(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := s.sessions.RevokeAllForUser(r.Context(), user.ID); err != nil {
+		log.Printf("Failed to revoke sessions: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to revoke sessions")
+		return
+	}
+
+	s.audit(r, user.ID, auditSessionRevoked, adminDetails(r, map[string]any{"reason": "admin", "all": true}))
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// AdminListAuditEvents returns audit events of every user, or of the one
+// named by the user parameter (a name or ID), with the paging of GET
+// /me/activity
+func (s *Server) AdminListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user")
+	if userID != "" {
+		user, err := s.db.GetUserByName(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to get user: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list activity")
+			return
+		}
+		if user != nil {
+			userID = user.ID
+		}
+	}
+	s.writeAuditEvents(w, r, userID)
+}
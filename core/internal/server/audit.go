@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"core/internal/database"
+	"core/internal/models"
+)
+
+// Audit event types
+const (
+	auditUserRegistered         = "user_registered"
+	auditLoginSucceeded         = "login_succeeded"
+	auditLoginFailed            = "login_failed"
+	auditCredentialAdded        = "credential_added"
+	auditCredentialRenamed      = "credential_renamed"
+	auditCredentialRemoved      = "credential_removed"
+	auditCredentialCloned       = "credential_clone_detected"
+	auditCredentialReinstated   = "credential_reinstated"
+	auditSessionRevoked         = "session_revoked"
+	auditRecoveryCodesGenerated = "recovery_codes_generated"
+	auditRecoveryCodeUsed       = "recovery_code_used"
+	auditRecoveryFailed         = "recovery_failed"
+	auditRecoveryEnrolled       = "recovery_passkey_enrolled"
+	auditRecoveryEmailSent      = "recovery_email_sent"
+	auditRecoveryLinkUsed       = "recovery_link_used"
+	auditEmailChanged           = "email_changed"
+	auditEmailVerified          = "email_verified"
+	auditAccountDisabled        = "account_disabled"
+	auditAccountEnabled         = "account_enabled"
+	auditRoleChanged            = "role_changed"
+)
+
+const (
+	// defaultActivityLimit is the page size of GET /me/activity
+	defaultActivityLimit = 50
+	// maxActivityLimit bounds the page size a client may ask for
+	maxActivityLimit = 200
+)
+
+// RecordRoleChange records that an operator set the user's role from the
+// command line
+func RecordRoleChange(ctx context.Context, db database.Service, userID, role string) error {
+	return db.RecordAuditEvent(ctx, &models.AuditEvent{
+		UserID:    userID,
+		Type:      auditRoleChanged,
+		Details:   map[string]any{"role": role, "via": "cli"},
+		CreatedAt: time.Now(),
+	})
+}
+
+// audit records a security-relevant event on a user's account
+func (s *Server) audit(r *http.Request, userID, event string, details map[string]any) {
+	s.auditCredential(r, userID, event, nil, details)
+}
+
+// auditCredential records an event involving one of the user's credentials
+func (s *Server) auditCredential(r *http.Request, userID, event string, credential *models.Credential, details map[string]any) {
+	e := &models.AuditEvent{
+		UserID:    userID,
+		Type:      event,
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+	if credential != nil {
+		e.CredentialID = credential.ID
+		e.AAGUID = credential.AAGUID
+	}
+
+	// Losing the record must not fail the request it describes, nor should
+	// a client hanging up keep it from being written
+	if err := s.db.RecordAuditEvent(context.WithoutCancel(r.Context()), e); err != nil {
+		log.Printf("Failed to record audit event %s for user %s: %v %v", event, userID, err, details)
+	}
+}
+
+// auditLoginFailure records a rejected assertion. The credential it claimed
+// to be from names the account when the user is not known yet.
+func (s *Server) auditLoginFailure(r *http.Request, userID string, rawID []byte, reason string) {
+	credential, err := s.db.GetCredential(r.Context(), rawID)
+	if err != nil {
+		log.Printf("Failed to load credential: %v", err)
+	}
+	if credential != nil && userID != "" && credential.UserID != userID {
+		credential = nil
+	}
+	if credential != nil {
+		userID = credential.UserID
+	}
+	s.auditCredential(r, userID, auditLoginFailed, credential, map[string]any{"reason": reason})
+}
+
+// clientIP returns the address the request came from. Requests relayed by
+// a trusted proxy name the client in X-Forwarded-For, whose entries are read
+// from the right until one not added by a trusted proxy, or in X-Real-IP.
+// Headers from anyone else are ignored, as clients can set them freely.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !s.trustedProxy(remote) {
+		return host
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr
+			if !s.trustedProxy(addr) {
+				break
+			}
+		}
+		return client.Unmap().String()
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// trustedProxy reports whether addr is one of the configured reverse proxies
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditEventResponse is the public view of an audit event
+type auditEventResponse struct {
+	ID                string         `json:"id"`
+	UserID            string         `json:"userID"`
+	Type              string         `json:"type"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	IP                string         `json:"ip"`
+	UserAgent         string         `json:"userAgent"`
+	CredentialID      string         `json:"credentialID,omitempty"`
+	AuthenticatorName string         `json:"authenticatorName,omitempty"`
+	AuthenticatorIcon string         `json:"authenticatorIcon,omitempty"` // data: URL for light backgrounds
+	Details           map[string]any `json:"details,omitempty"`
+}
+
+func (s *Server) newAuditEventResponse(event *models.AuditEvent) auditEventResponse {
+	a := s.authenticator(event.AAGUID)
+	return auditEventResponse{
+		ID:                event.ID,
+		UserID:            event.UserID,
+		Type:              event.Type,
+		CreatedAt:         event.CreatedAt,
+		IP:                event.IP,
+		UserAgent:         event.UserAgent,
+		CredentialID:      event.CredentialID,
+		AuthenticatorName: a.Name,
+		AuthenticatorIcon: a.IconLight,
+		Details:           event.Details,
+	}
+}
+
+// GetActivity returns the signed-in user's audit events, newest first. The
+// optional type parameter is a comma-separated list of event types; cursor
+// continues from the nextCursor of the previous page.
+func (s *Server) GetActivity(w http.ResponseWriter, r *http.Request) {
+	s.writeAuditEvents(w, r, userFromContext(r).ID)
+}
+
+// writeAuditEvents responds with a page of audit events, of every user when
+// userID is empty, selected by the limit, cursor and type parameters
+func (s *Server) writeAuditEvents(w http.ResponseWriter, r *http.Request, userID string) {
+	query := r.URL.Query()
+
+	limit := defaultActivityLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxActivityLimit {
+			jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	filter := database.AuditFilter{
+		UserID: userID,
+		Cursor: query.Get("cursor"),
+		// One more than a page tells whether there is a next one
+		Limit: limit + 1,
+	}
+	if v := query.Get("type"); v != "" {
+		filter.Types = strings.Split(v, ",")
+	}
+
+	events, err := s.db.ListAuditEvents(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list audit events: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list activity")
+		return
+	}
+
+	response := struct {
+		Events     []auditEventResponse `json:"events"`
+		NextCursor string               `json:"nextCursor,omitempty"`
+	}{
+		Events: make([]auditEventResponse, 0, len(events)),
+	}
+	if len(events) > limit {
+		events = events[:limit]
+		response.NextCursor = events[limit-1].ID
+	}
+	for i := range events {
+		response.Events = append(response.Events, s.newAuditEventResponse(&events[i]))
+	}
+
+	jsonResponse(w, response)
+}
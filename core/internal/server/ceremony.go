@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"core/internal/database"
+	"core/internal/models"
+)
+
+// defaultCeremonyTTL bounds ceremonies whose SessionData carries no expiry
+const defaultCeremonyTTL = 5 * time.Minute
+
+// ErrCeremonyNotFound is returned when a ceremony is unknown or has expired
+var ErrCeremonyNotFound = errors.New("ceremony not found")
+
+// Ceremony is the server-side state of an in-flight WebAuthn ceremony
+type Ceremony struct {
+	Session *webauthn.SessionData `json:"session"`
+
+	// Conditional marks a passkey autofill challenge issued before the user is known
+	Conditional bool `json:"conditional,omitempty"`
+
+	// AddCredential marks a registration enrolling another credential for a signed-in user
+	AddCredential bool `json:"addCredential,omitempty"`
+
+	// Reinstate is the suspended credential an assertion with another credential lifts
+	Reinstate string `json:"reinstate,omitempty"`
+
+	// PendingUser is the account a sign-up ceremony creates once it finishes
+	PendingUser *models.User `json:"pendingUser,omitempty"`
+}
+
+// login reports whether the ceremony was begun by one of the login endpoints,
+// rather than for a sign-up, an enrollment or a reinstatement
+func (c *Ceremony) login() bool {
+	return !c.AddCredential && c.Reinstate == "" && c.PendingUser == nil
+}
+
+// expiresAt returns when the ceremony stops being valid
+func (c *Ceremony) expiresAt() time.Time {
+	if c.Session != nil && !c.Session.Expires.IsZero() {
+		return c.Session.Expires
+	}
+	return time.Now().Add(defaultCeremonyTTL)
+}
+
+// CeremonyStore keeps WebAuthn ceremonies between the begin and finish
+// requests, keyed by an opaque ceremony ID
+type CeremonyStore interface {
+	// Save stores the ceremony and returns its newly generated ID
+	Save(ctx context.Context, ceremony *Ceremony) (string, error)
+
+	// Take removes the ceremony and returns it, or ErrCeremonyNotFound if it
+	// is unknown, expired or was already taken. Of concurrent calls for one
+	// ID at most one succeeds.
+	Take(ctx context.Context, id string) (*Ceremony, error)
+
+	// Delete removes the ceremony; deleting an unknown ID is not an error
+	Delete(ctx context.Context, id string) error
+
+	// Close stops the background sweeper
+	Close() error
+}
+
+// newCeremonyID returns a random, URL-safe ceremony ID
+func newCeremonyID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startSweeper calls sweep every interval until the returned stop function is called
+func startSweeper(interval time.Duration, sweep func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sweep()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+type memoryCeremony struct {
+	ceremony  *Ceremony
+	expiresAt time.Time
+}
+
+type memoryCeremonyStore struct {
+	mu         sync.Mutex
+	ceremonies map[string]memoryCeremony
+	stop       func()
+}
+
+// NewMemoryCeremonyStore returns a process-local CeremonyStore that drops
+// expired ceremonies every sweepInterval
+func NewMemoryCeremonyStore(sweepInterval time.Duration) CeremonyStore {
+	s := &memoryCeremonyStore{
+		ceremonies: make(map[string]memoryCeremony),
+	}
+	s.stop = startSweeper(sweepInterval, s.sweep)
+	return s
+}
+
+func (s *memoryCeremonyStore) Save(ctx context.Context, ceremony *Ceremony) (string, error) {
+	id, err := newCeremonyID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.ceremonies[id] = memoryCeremony{ceremony: ceremony, expiresAt: ceremony.expiresAt()}
+	s.mu.Unlock()
+
+	return id, nil
+}
+
+func (s *memoryCeremonyStore) Take(ctx context.Context, id string) (*Ceremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.ceremonies[id]
+	if !ok {
+		return nil, ErrCeremonyNotFound
+	}
+	delete(s.ceremonies, id)
+	if !entry.expiresAt.After(time.Now()) {
+		return nil, ErrCeremonyNotFound
+	}
+	return entry.ceremony, nil
+}
+
+func (s *memoryCeremonyStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	delete(s.ceremonies, id)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryCeremonyStore) Close() error {
+	s.stop()
+	return nil
+}
+
+func (s *memoryCeremonyStore) sweep() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, entry := range s.ceremonies {
+		if !entry.expiresAt.After(now) {
+			delete(s.ceremonies, id)
+		}
+	}
+}
+
+type databaseCeremonyStore struct {
+	db   database.Service
+	stop func()
+}
+
+// NewDatabaseCeremonyStore returns a CeremonyStore backed by the ceremonies
+// table, so ceremonies survive restarts and are shared between replicas
+func NewDatabaseCeremonyStore(db database.Service, sweepInterval time.Duration) CeremonyStore {
+	s := &databaseCeremonyStore{db: db}
+	s.stop = startSweeper(sweepInterval, s.sweep)
+	return s
+}
+
+func (s *databaseCeremonyStore) Save(ctx context.Context, ceremony *Ceremony) (string, error) {
+	id, err := newCeremonyID()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(ceremony)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.SaveCeremony(ctx, &models.Ceremony{
+		ID:        id,
+		Data:      data,
+		ExpiresAt: ceremony.expiresAt(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *databaseCeremonyStore) Take(ctx context.Context, id string) (*Ceremony, error) {
+	record, err := s.db.TakeCeremony(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrCeremonyNotFound
+	}
+
+	var ceremony Ceremony
+	if err := json.Unmarshal(record.Data, &ceremony); err != nil {
+		return nil, err
+	}
+	return &ceremony, nil
+}
+
+func (s *databaseCeremonyStore) Delete(ctx context.Context, id string) error {
+	return s.db.DeleteCeremony(ctx, id)
+}
+
+func (s *databaseCeremonyStore) Close() error {
+	s.stop()
+	return nil
+}
+
+func (s *databaseCeremonyStore) sweep() {
+	n, err := s.db.DeleteExpiredCeremonies(context.Background(), time.Now())
+	if err != nil {
+		log.Printf("Failed to delete expired ceremonies: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Deleted %d expired ceremonies", n)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"core/internal/models"
+)
+
+// errCredentialSuspended is returned when a login uses a suspended credential
+var errCredentialSuspended = errors.New("credential suspended")
+
+// enforceClonePolicy runs after an assertion has been validated. Suspended
+// credentials are rejected. A signature counter that did not increase, which
+// the library reports as CloneWarning, is recorded and reported to the user
+// the first time, and suspends the credential when clone_action is suspend.
+func (s *Server) enforceClonePolicy(r *http.Request, user *models.User, credential *webauthn.Credential) (*models.Credential, error) {
+	ctx := r.Context()
+	stored, err := s.db.GetCredential(ctx, credential.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, errors.New("credential not found")
+	}
+	if stored.SuspendedAt != nil {
+		return stored, errCredentialSuspended
+	}
+	if !credential.Authenticator.CloneWarning {
+		return stored, nil
+	}
+
+	suspend := s.cfg.WebAuthn.CloneAction == "suspend"
+
+	// A credential already flagged under the warn action is only reported once
+	if !stored.CloneWarning || suspend {
+		log.Printf("Signature counter of credential %s (%s) did not increase past %d", stored.ID, s.authenticator(stored.AAGUID).Name, stored.SignCount)
+
+		err := s.db.RecordCloneEvent(ctx, &models.CloneEvent{
+			CredentialID: stored.ID,
+			UserID:       user.ID,
+			SignCount:    stored.SignCount,
+			Action:       s.cfg.WebAuthn.CloneAction,
+			CreatedAt:    time.Now(),
+		}, suspend)
+		if err != nil {
+			return nil, err
+		}
+		s.auditCredential(r, user.ID, auditCredentialCloned, stored, map[string]any{
+			"action":    s.cfg.WebAuthn.CloneAction,
+			"signCount": stored.SignCount,
+		})
+
+		if err := s.notifier.CredentialCloned(ctx, user, stored, suspend); err != nil {
+			log.Printf("Failed to notify user %s: %v", user.ID, err)
+		}
+	}
+
+	if !suspend {
+		return stored, nil
+	}
+
+	// Whoever holds the clone may already be signed in
+	if err := s.sessions.RevokeAllForUser(ctx, user.ID); err != nil {
+		log.Printf("Failed to revoke sessions of user %s: %v", user.ID, err)
+	}
+	return stored, errCredentialSuspended
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// conditionalLoginTimeout keeps autofill challenges alive while the login page
+// sits open, well beyond the timeout of an explicit login
+const conditionalLoginTimeout = 10 * time.Minute
+
+// beginConditionalLogin issues a challenge for passkey autofill
+// (mediation: "conditional"). No username is known yet, so the assertion has
+// no allowCredentials and the user is resolved from the user handle at finish.
+func (s *Server) beginConditionalLogin(w http.ResponseWriter, r *http.Request) {
+	options, sessionData, err := s.webAuthn.BeginDiscoverableLogin(
+		func(o *protocol.PublicKeyCredentialRequestOptions) {
+			o.Timeout = int(conditionalLoginTimeout.Milliseconds())
+		},
+	)
+	if err != nil {
+		log.Printf("Failed to begin conditional login: %v", err)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login", err)
+		return
+	}
+
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData, Conditional: true})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login")
+		return
+	}
+
+	response := struct {
+		PublicKey  *protocol.CredentialAssertion `json:"publicKey"`
+		CeremonyID string                        `json:"ceremonyID"`
+		Mediation  string                        `json:"mediation"`
+	}{
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
+		Mediation:  "conditional",
+	}
+
+	jsonResponse(w, response)
+}
+
+// CancelLogin discards a pending login ceremony, e.g. when the page aborts an
+// autofill request to start an explicit login. Unknown IDs are ignored.
+func (s *Server) CancelLogin(w http.ResponseWriter, r *http.Request) {
+	ceremonyID := ceremonyIDFromRequest(r)
+	if ceremonyID == "" {
+		log.Printf("CeremonyID not provided")
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "CeremonyID not provided")
+		return
+	}
+
+	if err := s.ceremonies.Delete(r.Context(), ceremonyID); err != nil {
+		log.Printf("Failed to delete ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to cancel login")
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
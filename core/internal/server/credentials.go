@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+
+	"core/internal/aaguid"
+	"core/internal/database"
+	"core/internal/models"
+)
+
+// maxNicknameLength bounds user-chosen credential names
+const maxNicknameLength = 64
+
+// authenticator names the model a credential was created on. Models missing
+// from the catalog fall back to the metadata BLOB when one is loaded.
+func (s *Server) authenticator(aaguidBytes []byte) aaguid.Authenticator {
+	if a, ok := s.authenticators.Lookup(aaguidBytes); ok {
+		return a
+	}
+
+	id, err := uuid.FromBytes(aaguidBytes)
+	if err != nil || id == uuid.Nil || s.attestation.mds == nil {
+		return aaguid.Authenticator{}
+	}
+	entry, err := s.attestation.mds.GetEntry(context.Background(), id)
+	if err != nil || entry == nil {
+		return aaguid.Authenticator{}
+	}
+
+	a := aaguid.Authenticator{Name: entry.MetadataStatement.Description}
+	if icon := entry.MetadataStatement.Icon; icon != nil {
+		a.IconLight = icon.String()
+		a.IconDark = icon.String()
+	}
+	return a
+}
+
+// credentialResponse is the public view of a stored credential
+type credentialResponse struct {
+	ID                     string                            `json:"id"`
+	Nickname               string                            `json:"nickname"`
+	AuthenticatorName      string                            `json:"authenticatorName"`
+	AuthenticatorIconLight string                            `json:"authenticatorIconLight,omitempty"` // data: URL
+	AuthenticatorIconDark  string                            `json:"authenticatorIconDark,omitempty"`
+	CreatedAt              time.Time                         `json:"createdAt"`
+	LastUsedAt             *time.Time                        `json:"lastUsedAt"`
+	Attachment             protocol.AuthenticatorAttachment  `json:"attachment"`
+	Transports             []protocol.AuthenticatorTransport `json:"transports"`
+	BackupEligible         bool                              `json:"backupEligible"`
+	BackupState            bool                              `json:"backupState"`
+	CloneWarning           bool                              `json:"cloneWarning"`
+	SuspendedAt            *time.Time                        `json:"suspendedAt"`
+}
+
+func (s *Server) newCredentialResponse(cred *models.Credential) credentialResponse {
+	a := s.authenticator(cred.AAGUID)
+	return credentialResponse{
+		ID:                     cred.ID,
+		Nickname:               cred.Nickname,
+		AuthenticatorName:      a.Name,
+		AuthenticatorIconLight: a.IconLight,
+		AuthenticatorIconDark:  a.IconDark,
+		CreatedAt:              cred.CreatedAt,
+		LastUsedAt:             cred.LastUsedAt,
+		Attachment:             cred.Attachment,
+		Transports:             cred.Transports,
+		BackupEligible:         cred.BackupEligible,
+		BackupState:            cred.BackupState,
+		CloneWarning:           cred.CloneWarning,
+		SuspendedAt:            cred.SuspendedAt,
+	}
+}
+
+// auditedCredential loads one of the user's credentials by record ID for an
+// audit event. The ID alone is returned when the credential cannot be found.
+func (s *Server) auditedCredential(r *http.Request, userID, id string) *models.Credential {
+	credentials, err := s.db.ListCredentialsForUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to list credentials: %v", err)
+	}
+	for i := range credentials {
+		if credentials[i].ID == id {
+			return &credentials[i]
+		}
+	}
+	return &models.Credential{ID: id}
+}
+
+// userFromContext returns the user stored by AuthMiddleware
+func userFromContext(r *http.Request) *models.User {
+	user, _ := r.Context().Value("user").(*models.User)
+	return user
+}
+
+// BeginAddCredential starts a registration ceremony that enrolls another
+// authenticator for the signed-in user
+func (s *Server) BeginAddCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	credentials, err := s.db.GetCredentialsForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to load credentials: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration")
+		return
+	}
+
+	// Stop the browser from re-registering an authenticator the user already has
+	exclusions := make([]protocol.CredentialDescriptor, len(credentials))
+	for i, credential := range credentials {
+		exclusions[i] = credential.Descriptor()
+	}
+
+	options, sessionData, err := s.webAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		log.Printf("Failed to begin registration: %v", err)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration", err)
+		return
+	}
+
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData, AddCredential: true})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration")
+		return
+	}
+
+	response := struct {
+		PublicKey  *protocol.CredentialCreation `json:"publicKey"`
+		CeremonyID string                       `json:"ceremonyID"`
+	}{
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
+	}
+
+	jsonResponse(w, response)
+}
+
+// FinishAddCredential verifies the new authenticator and stores it for the
+// signed-in user
+func (s *Server) FinishAddCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	ceremony, ok := s.takeCeremony(w, r)
+	if !ok {
+		return
+	}
+
+	// The ceremony must have been started by this user from this endpoint
+	if !ceremony.AddCredential || string(ceremony.Session.UserID) != user.ID {
+		log.Printf("Ceremony does not belong to user %s", user.ID)
+		jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
+		return
+	}
+
+	credential, err := s.webAuthn.FinishRegistration(user, *ceremony.Session, r)
+	if err != nil {
+		log.Printf("Failed to finish registration: %v", err)
+		s.webauthnError(w, r, http.StatusBadRequest, codeRegistrationFailed, "Failed to finish registration", err)
+		return
+	}
+
+	if err := s.attestation.check(r.Context(), credential); err != nil {
+		log.Printf("Refused credential for user %s: %v", user.ID, err)
+		s.webauthnError(w, r, http.StatusForbidden, codeAuthenticatorNotAllowed, "Authenticator not allowed", err)
+		return
+	}
+
+	record := newCredentialRecord(user.ID, credential)
+	err = s.db.SaveCredential(r.Context(), record)
+	if errors.Is(err, database.ErrCredentialExists) {
+		jsonError(w, r, http.StatusConflict, codeCredentialExists, "Credential already registered")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to save credential")
+		return
+	}
+
+	log.Printf("Successfully added credential for user %s", user.ID)
+	s.auditCredential(r, user.ID, auditCredentialAdded, record, nil)
+
+	// A recovery session ends once its one job is done and becomes a full
+	// session, still bound by its short expiry; other sessions are rotated as
+	// the account gained a passkey
+	recovered := sessionFromContext(r).Scope == sessionScopeRecovery
+	tokens, err := s.rotateSession(w, r, "")
+	if err != nil {
+		log.Printf("Failed to rotate session: %v", err)
+		s.clearSessionCookies(w)
+	}
+	if recovered {
+		s.audit(r, user.ID, auditRecoveryEnrolled, nil)
+	}
+
+	jsonResponse(w, struct {
+		Status string `json:"status"`
+		*sessionTokens
+	}{"ok", tokens})
+}
+
+// ListCredentials returns the signed-in user's passkeys
+func (s *Server) ListCredentials(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	credentials, err := s.db.ListCredentialsForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to list credentials: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to list credentials")
+		return
+	}
+
+	response := make([]credentialResponse, len(credentials))
+	for i := range credentials {
+		response[i] = s.newCredentialResponse(&credentials[i])
+	}
+
+	jsonResponse(w, response)
+}
+
+// RenameCredential sets the friendly name of one of the signed-in user's passkeys
+func (s *Server) RenameCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	var req struct {
+		Nickname string `json:"nickname"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	req.Nickname = strings.TrimSpace(req.Nickname)
+	if err != nil || len(req.Nickname) > maxNicknameLength {
+		log.Printf("Invalid request payload: %v", err)
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	err = s.db.RenameCredential(r.Context(), user.ID, id, req.Nickname)
+	if err != nil {
+		if errors.Is(err, database.ErrCredentialNotFound) {
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+			return
+		}
+		log.Printf("Failed to rename credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to rename credential")
+		return
+	}
+	s.auditCredential(r, user.ID, auditCredentialRenamed, s.auditedCredential(r, user.ID, id), map[string]any{"nickname": req.Nickname})
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// DeleteCredential removes one of the signed-in user's passkeys. The last
+// passkey cannot be removed, since the user would be locked out.
+func (s *Server) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+	id := chi.URLParam(r, "id")
+
+	// Looked up first, as the audit log keeps the authenticator model
+	credential := s.auditedCredential(r, user.ID, id)
+
+	err := s.db.DeleteCredential(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrCredentialNotFound):
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+		case errors.Is(err, database.ErrLastCredential):
+			jsonError(w, r, http.StatusConflict, codeLastCredential, "Cannot delete the last usable credential")
+		default:
+			log.Printf("Failed to delete credential: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to delete credential")
+		}
+		return
+	}
+
+	log.Printf("Deleted credential %s for user %s", id, user.ID)
+	s.auditCredential(r, user.ID, auditCredentialRemoved, credential, nil)
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// BeginReinstateCredential challenges the signed-in user to assert with
+// another, unsuspended credential before one flagged as cloned is reinstated.
+// A session alone is not enough, as it may be what the clone's holder stole;
+// users with no other credential need an administrator.
+func (s *Server) BeginReinstateCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+	id := chi.URLParam(r, "id")
+
+	credentials, err := s.db.ListCredentialsForUser(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to load credentials: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin reinstatement")
+		return
+	}
+
+	found := false
+	var allowed []protocol.CredentialDescriptor
+	for _, credential := range credentials {
+		switch {
+		case credential.ID == id:
+			found = true
+		case credential.SuspendedAt == nil:
+			allowed = append(allowed, credential.ToWebauthnCredential().Descriptor())
+		}
+	}
+	if !found {
+		jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+		return
+	}
+	if len(allowed) == 0 {
+		jsonError(w, r, http.StatusConflict, codeLastCredential, "Another passkey is needed to reinstate this one")
+		return
+	}
+
+	options, sessionData, err := s.webAuthn.BeginLogin(user, webauthn.WithAllowedCredentials(allowed))
+	if err != nil {
+		log.Printf("Failed to begin reinstatement: %v", err)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin reinstatement", err)
+		return
+	}
+
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData, Reinstate: id})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin reinstatement")
+		return
+	}
+
+	response := struct {
+		PublicKey  *protocol.CredentialAssertion `json:"publicKey"`
+		CeremonyID string                        `json:"ceremonyID"`
+	}{
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
+	}
+
+	jsonResponse(w, response)
+}
+
+// ReinstateCredential finishes the ceremony begun by BeginReinstateCredential
+// and lifts the clone warning and suspension of the credential
+func (s *Server) ReinstateCredential(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+	id := chi.URLParam(r, "id")
+
+	ceremony, ok := s.takeCeremony(w, r)
+	if !ok {
+		return
+	}
+
+	// The ceremony must have been started by this user for this credential
+	if ceremony.Reinstate != id || string(ceremony.Session.UserID) != user.ID {
+		log.Printf("Ceremony does not belong to user %s", user.ID)
+		jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		log.Printf("Failed to parse assertion: %v", err)
+		s.webauthnError(w, r, http.StatusBadRequest, codeLoginFailed, "Failed to verify passkey", err)
+		return
+	}
+
+	if err := s.adoptLegacyFlags(r.Context(), user, parsed); err != nil {
+		log.Printf("Failed to load credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to verify passkey")
+		return
+	}
+
+	// Only the credentials offered at the start are accepted
+	credential, err := s.webAuthn.ValidateLogin(user, *ceremony.Session, parsed)
+	if err != nil {
+		log.Printf("Reinstatement assertion failed: %+v", err)
+		s.auditLoginFailure(r, user.ID, parsed.RawID, "invalid assertion")
+		s.webauthnError(w, r, http.StatusUnauthorized, codeLoginFailed, "Failed to verify passkey", err)
+		return
+	}
+
+	// The vouching credential may have been suspended or cloned since
+	stored, err := s.enforceClonePolicy(r, user, credential)
+	if err != nil {
+		if errors.Is(err, errCredentialSuspended) {
+			jsonError(w, r, http.StatusForbidden, codeCredentialSuspended, "Credential suspended")
+			return
+		}
+		log.Printf("Failed to check credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to check credential")
+		return
+	}
+	if stored.ID == id {
+		jsonError(w, r, http.StatusForbidden, codeForbidden, "A passkey cannot vouch for itself")
+		return
+	}
+
+	err = s.db.UpdateCredentialAfterLogin(r.Context(), credential.ID, credential.Authenticator.SignCount, credential.Flags)
+	if err != nil {
+		log.Printf("Failed to update credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to update credential")
+		return
+	}
+
+	err = s.db.ReinstateCredential(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, database.ErrCredentialNotFound) {
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "Credential not found")
+			return
+		}
+		log.Printf("Failed to reinstate credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to reinstate credential")
+		return
+	}
+
+	log.Printf("Reinstated credential %s for user %s", id, user.ID)
+	s.auditCredential(r, user.ID, auditCredentialReinstated, s.auditedCredential(r, user.ID, id), map[string]any{"verifiedWith": stored.ID})
+
+	tokens, err := s.rotateSession(w, r, sessionFromContext(r).Scope)
+	if err != nil {
+		log.Printf("Failed to rotate session: %v", err)
+		s.clearSessionCookies(w)
+	}
+
+	jsonResponse(w, struct {
+		Status string `json:"status"`
+		*sessionTokens
+	}{"ok", tokens})
+}
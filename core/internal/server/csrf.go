@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// csrfCookie holds the double-submit token; it gets the __Host- prefix
+	// along with the session cookie
+	csrfCookie = "csrf_token"
+	// csrfHeader echoes the token on state-changing requests
+	csrfHeader = "X-CSRF-Token"
+	// csrfTokenLifetime is how long a browser keeps its token
+	csrfTokenLifetime = 24 * time.Hour
+)
+
+// CSRFMiddleware refuses state-changing requests that a third-party page
+// could have made with the user's cookies. In origin mode the browser's
+// Origin and Sec-Fetch-Site headers must name a trusted origin; in
+// double_submit mode the X-CSRF-Token header must match the csrf_token
+// cookie, which other sites can neither read nor set.
+func (s *Server) CSRFMiddleware(next http.Handler) http.Handler {
+	trusted := make(map[string]bool)
+	for _, origin := range s.cfg.CORS.AllowedOrigins {
+		trusted[origin] = true
+	}
+	for _, origin := range s.cfg.WebAuthn.RPOrigins {
+		trusted[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Pages on other sites cannot set Authorization without passing CORS,
+		// and a request that sends a bearer token is not authenticated by cookie
+		if bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var err error
+		if s.cfg.CSRF.Mode == "double_submit" {
+			err = s.checkCSRFToken(r)
+		} else {
+			err = checkOrigin(r, trusted)
+		}
+		if err != nil {
+			log.Printf("Refused %s %s: %v", r.Method, r.URL.Path, err)
+			jsonError(w, r, http.StatusForbidden, codeCSRF, "Cross-site request refused")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin accepts requests from trusted origins and from clients that
+// are not browsers, which send neither Origin nor Sec-Fetch-Site
+func checkOrigin(r *http.Request, trusted map[string]bool) error {
+	site := r.Header.Get("Sec-Fetch-Site")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if site == "" || site == "same-origin" || site == "none" {
+			return nil
+		}
+		return fmt.Errorf("%s request without Origin", site)
+	}
+	if trusted[origin] || site == "same-origin" {
+		return nil
+	}
+	return fmt.Errorf("untrusted origin %q", origin)
+}
+
+// checkCSRFToken compares the X-CSRF-Token header with the csrf_token cookie
+func (s *Server) checkCSRFToken(r *http.Request) error {
+	cookie, err := r.Cookie(s.cookieName(csrfCookie))
+	if err != nil || cookie.Value == "" {
+		return errors.New("no CSRF cookie")
+	}
+	header := r.Header.Get(csrfHeader)
+	if header == "" {
+		return errors.New("no CSRF token")
+	}
+	if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+		return errors.New("CSRF token does not match cookie")
+	}
+	return nil
+}
+
+// CSRFToken returns the token to send in the X-CSRF-Token header, setting
+// the csrf_token cookie if the browser has none. Origin mode needs no token
+// but the endpoint stays so clients work under either mode.
+func (s *Server) CSRFToken(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if cookie, err := r.Cookie(s.cookieName(csrfCookie)); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Printf("Failed to generate CSRF token: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to generate CSRF token")
+			return
+		}
+		token = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	// Refresh the cookie so an active browser keeps its token
+	http.SetCookie(w, s.newCookie(csrfCookie, token, time.Now().Add(csrfTokenLifetime)))
+
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, map[string]string{"token": token})
+}
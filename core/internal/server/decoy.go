@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+
+	"core/internal/models"
+)
+
+// decoyTransports are the transport hints given for decoy credentials, as
+// reported by common platform authenticators and security keys
+var decoyTransports = [][]protocol.AuthenticatorTransport{
+	{protocol.Internal, protocol.Hybrid},
+	{protocol.USB, protocol.NFC},
+	{protocol.Internal},
+}
+
+// decoySecretName names the server secret decoys are derived from
+const decoySecretName = "decoy"
+
+// decoyMAC returns an HMAC-SHA256 of data for purpose, keyed by the decoy
+// secret
+func (s *Server) decoyMAC(purpose string, data []byte) []byte {
+	h := hmac.New(sha256.New, s.decoySecret)
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// decoyUser stands in for a username with no account when
+// webauthn.hide_unknown_users is set. It is derived from the username with
+// a server secret, so repeated logins get the same allowCredentials, as they
+// would for a real user, yet nobody can compute them offline. Its ID matches
+// no user, so the login fails at finish.
+func (s *Server) decoyUser(username string) *models.User {
+	seed := s.decoyMAC("decoy-user", []byte(username))
+
+	id := uuid.Must(uuid.FromBytes(seed[:16]))
+	id[6] = id[6]&0x0f | 0x40 // version 4, like real user IDs
+	id[8] = id[8]&0x3f | 0x80
+
+	user := &models.User{
+		ID:          id.String(),
+		Name:        username,
+		DisplayName: username,
+	}
+
+	// Most people have one or two passkeys
+	count := 1 + int(seed[16]%2)
+	for i := 0; i < count; i++ {
+		credentialID := s.decoyMAC("decoy-credential", []byte(username+"\x00"+strconv.Itoa(i)))
+		user.Credentials = append(user.Credentials, webauthn.Credential{
+			ID:        credentialID,
+			Transport: decoyTransports[int(credentialID[0])%len(decoyTransports)],
+		})
+	}
+	return user
+}
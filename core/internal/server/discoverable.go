@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"core/internal/models"
+)
+
+// BeginDiscoverableLogin starts a usernameless login where the authenticator
+// picks one of its resident credentials for this relying party
+func (s *Server) BeginDiscoverableLogin(w http.ResponseWriter, r *http.Request) {
+	options, sessionData, err := s.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		log.Printf("Failed to begin discoverable login: %v", err)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login", err)
+		return
+	}
+
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login")
+		return
+	}
+
+	response := struct {
+		PublicKey  *protocol.CredentialAssertion `json:"publicKey"`
+		CeremonyID string                        `json:"ceremonyID"`
+	}{
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
+	}
+
+	jsonResponse(w, response)
+}
+
+// FinishDiscoverableLogin completes a usernameless login, resolving the user
+// from the credential and user handle returned by the authenticator
+func (s *Server) FinishDiscoverableLogin(w http.ResponseWriter, r *http.Request) {
+	ceremony, ok := s.takeCeremony(w, r)
+	if !ok {
+		return
+	}
+
+	// Other ceremonies must not mint a session
+	if !ceremony.login() {
+		log.Printf("Ceremony was not begun for a login")
+		jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
+		return
+	}
+
+	s.finishDiscoverableLogin(w, r, ceremony)
+}
+
+// finishDiscoverableLogin validates an assertion for a ceremony that was
+// begun without a user, resolving the user from the returned user handle
+func (s *Server) finishDiscoverableLogin(w http.ResponseWriter, r *http.Request, ceremony *Ceremony) {
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		log.Printf("Failed to parse assertion: %v", err)
+		s.webauthnError(w, r, http.StatusBadRequest, codeLoginFailed, "Failed to finish login", err)
+		return
+	}
+
+	var user *models.User
+	credential, err := s.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		user, err = s.userForUserHandle(r.Context(), rawID, userHandle)
+		if err != nil {
+			return nil, err
+		}
+		return user, s.adoptLegacyFlags(r.Context(), user, parsed)
+	}, *ceremony.Session, parsed)
+	if err != nil {
+		log.Printf("Discoverable login failed with detailed error: %+v", err)
+		s.auditLoginFailure(r, "", parsed.RawID, "invalid assertion")
+		s.webauthnError(w, r, http.StatusUnauthorized, codeLoginFailed, "Failed to finish login", err)
+		return
+	}
+
+	log.Printf("Successfully validated discoverable credential for user %s", user.ID)
+
+	s.completeLogin(w, r, user, credential)
+}
+
+// userForUserHandle looks up the owner of a discoverable credential and checks
+// that the user handle reported by the authenticator belongs to them
+func (s *Server) userForUserHandle(ctx context.Context, rawID, userHandle []byte) (*models.User, error) {
+	user, err := s.db.GetUserByCredentialID(ctx, rawID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("credential not found")
+	}
+	if string(userHandle) != user.ID {
+		return nil, errors.New("user handle does not match credential owner")
+	}
+	return user, nil
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"core/internal/config"
+	"core/internal/database"
+	"core/internal/mail"
+	"core/internal/models"
+)
+
+// Magic link purposes
+const (
+	linkVerifyEmail  = "verify_email"
+	linkPasskeyReset = "passkey_reset"
+)
+
+// emailLinkTokenType is the JWT typ of magic link tokens, so no other token
+// signed with the same keys can be passed off as one
+const emailLinkTokenType = "email-link+jwt"
+
+// emailSendTimeout bounds sending a link in the background
+const emailSendTimeout = time.Minute
+
+// errLinkRateLimited is returned when a user was sent too many links lately
+var errLinkRateLimited = errors.New("too many links sent")
+
+// errInvalidLink is returned for magic links that are forged, expired,
+// already used or meant for something else
+var errInvalidLink = errors.New("invalid or expired link")
+
+// magicLinks issues and redeems signed, single-use links sent by email
+type magicLinks struct {
+	db      database.Service
+	mailer  mail.Mailer
+	keys    *signingKeys
+	issuer  string
+	linkURL string
+	ttl     time.Duration
+	perHour int
+	stop    func()
+}
+
+// emailLinkClaims are the claims of a magic link token. The token's ID
+// names the email_links row that makes it single-use.
+type emailLinkClaims struct {
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func newMagicLinks(db database.Service, mailer mail.Mailer, keys *signingKeys, issuer string, cfg config.EmailConfig) *magicLinks {
+	m := &magicLinks{
+		db:      db,
+		mailer:  mailer,
+		keys:    keys,
+		issuer:  issuer,
+		linkURL: strings.TrimSuffix(cfg.LinkURL, "/"),
+		ttl:     cfg.LinkTTL,
+		perHour: cfg.LinksPerHour,
+	}
+	m.stop = startSweeper(10*time.Minute, func() {
+		if _, err := db.DeleteExpiredEmailLinks(context.Background(), time.Now()); err != nil {
+			log.Printf("Failed to delete expired email links: %v", err)
+		}
+	})
+	return m
+}
+
+// checkRate returns errLinkRateLimited if the user was sent too many links
+// in the last hour
+func (m *magicLinks) checkRate(ctx context.Context, userID string) error {
+	sent, err := m.db.CountEmailLinks(ctx, userID, time.Now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if sent >= m.perHour {
+		return errLinkRateLimited
+	}
+	return nil
+}
+
+// send emails the user a link for purpose to the given address
+func (m *magicLinks) send(ctx context.Context, user *models.User, purpose, email string) error {
+	if err := m.checkRate(ctx, user.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	link := &models.EmailLink{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.ttl),
+	}
+	if err := m.db.CreateEmailLink(ctx, link); err != nil {
+		return err
+	}
+
+	token, err := m.keys.sign(emailLinkTokenType, emailLinkClaims{
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        link.ID,
+			Issuer:    m.issuer,
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	minutes := int(m.ttl.Minutes())
+	var msg mail.Message
+	switch purpose {
+	case linkVerifyEmail:
+		msg = mail.Message{
+			To:      email,
+			Subject: "Confirm your email address",
+			Body: fmt.Sprintf("Hi %s,\n\nOpen the link below within %d minutes to confirm this address for your account %s.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+				user.DisplayName, minutes, user.Name, m.linkURL+"/verify-email?token="+url.QueryEscape(token)),
+		}
+	case linkPasskeyReset:
+		msg = mail.Message{
+			To:      email,
+			Subject: "Add a new passkey to your account",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to get back into your account %s. Open the link below within %d minutes to add a new passkey.\n\n%s\n\nIf this was not you, you can ignore this email; your passkeys keep working.\n",
+				user.DisplayName, user.Name, minutes, m.linkURL+"/recover?token="+url.QueryEscape(token)),
+		}
+	default:
+		return fmt.Errorf("unknown link purpose %q", purpose)
+	}
+	return m.mailer.Send(ctx, msg)
+}
+
+// redeem verifies a magic link token for purpose and consumes its link
+func (m *magicLinks) redeem(ctx context.Context, token, purpose string) (*models.EmailLink, error) {
+	var claims emailLinkClaims
+	err := m.keys.parse(token, emailLinkTokenType, &claims,
+		jwt.WithIssuer(m.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Purpose != purpose {
+		return nil, errInvalidLink
+	}
+
+	link, err := m.db.ConsumeEmailLink(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil || link.Purpose != purpose || link.UserID != claims.Subject {
+		return nil, errInvalidLink
+	}
+	return link, nil
+}
+
+// Close stops the background sweeper
+func (m *magicLinks) Close() error {
+	m.stop()
+	return nil
+}
+
+// normalizeEmail lowercases a bare address, returning "" if it is not one
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return ""
+	}
+	return email
+}
+
+// SetEmail changes the signed-in user's email address and sends a link to
+// verify it. An empty email removes the address.
+func (s *Server) SetEmail(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+	email := ""
+	if req.Email != "" {
+		if email = normalizeEmail(req.Email); email == "" {
+			jsonError(w, r, http.StatusBadRequest, codeInvalidEmail, "Invalid email address")
+			return
+		}
+	}
+
+	if email == user.Email && user.EmailVerified != nil {
+		jsonResponse(w, map[string]string{"status": "ok"})
+		return
+	}
+
+	// Keep the current address if no link could be sent for the new one
+	if email != "" {
+		if err := s.links.checkRate(r.Context(), user.ID); err != nil {
+			if errors.Is(err, errLinkRateLimited) {
+				jsonError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many emails sent, try again later")
+				return
+			}
+			log.Printf("Failed to count email links: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to set email")
+			return
+		}
+	}
+
+	if err := s.db.SetUserEmail(r.Context(), user.ID, email); err != nil {
+		log.Printf("Failed to set email: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to set email")
+		return
+	}
+	s.audit(r, user.ID, auditEmailChanged, nil)
+
+	if email == "" {
+		jsonResponse(w, map[string]string{"status": "ok"})
+		return
+	}
+
+	if err := s.links.send(r.Context(), user, linkVerifyEmail, email); err != nil {
+		if errors.Is(err, errLinkRateLimited) {
+			jsonError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many emails sent, try again later")
+			return
+		}
+		log.Printf("Failed to send verification email: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to send verification email")
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "verification_sent"})
+}
+
+// VerifyEmail confirms an email address with the token from a verification
+// link. It does not need a session, as links are often opened elsewhere.
+func (s *Server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	link, err := s.links.redeem(r.Context(), req.Token, linkVerifyEmail)
+	if err != nil {
+		if errors.Is(err, errInvalidLink) {
+			jsonError(w, r, http.StatusBadRequest, codeInvalidLink, "Invalid or expired link")
+			return
+		}
+		log.Printf("Failed to redeem link: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to verify email")
+		return
+	}
+
+	err = s.db.VerifyUserEmail(r.Context(), link.UserID, link.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEmailChanged):
+			jsonError(w, r, http.StatusBadRequest, codeInvalidLink, "Invalid or expired link")
+		case errors.Is(err, database.ErrEmailTaken):
+			jsonError(w, r, http.StatusConflict, codeEmailTaken, "Email address already in use")
+		default:
+			log.Printf("Failed to verify email: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to verify email")
+		}
+		return
+	}
+	s.audit(r, link.UserID, auditEmailVerified, nil)
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// BeginEmailRecovery emails a passkey reset link to a verified address. The
+// response is the same whether or not the address belongs to anyone, and is
+// sent before the address is even looked up, so its timing tells nothing
+// either.
+func (s *Server) BeginEmailRecovery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if email := normalizeEmail(req.Email); email != "" {
+		// The work outlives the request, which is canceled once answered
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), emailSendTimeout)
+		go func() {
+			defer cancel()
+			s.sendRecoveryEmail(r.WithContext(ctx), email)
+		}()
+	}
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// sendRecoveryEmail sends a passkey reset link if email is the verified
+// address of an enabled user
+func (s *Server) sendRecoveryEmail(r *http.Request, email string) {
+	user, err := s.db.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+	}
+	if user == nil || user.DisabledAt != nil {
+		return
+	}
+
+	if err := s.links.send(r.Context(), user, linkPasskeyReset, email); err != nil {
+		log.Printf("Failed to send recovery email to user %s: %v", user.ID, err)
+		return
+	}
+	s.audit(r, user.ID, auditRecoveryEmailSent, nil)
+}
+
+// FinishEmailRecovery redeems a passkey reset link for a recovery session
+func (s *Server) FinishEmailRecovery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	link, err := s.links.redeem(r.Context(), req.Token, linkPasskeyReset)
+	if err != nil {
+		if errors.Is(err, errInvalidLink) {
+			jsonError(w, r, http.StatusBadRequest, codeInvalidLink, "Invalid or expired link")
+			return
+		}
+		log.Printf("Failed to redeem link: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to recover account")
+		return
+	}
+
+	// The address must still be the user's verified one
+	user, err := s.db.GetUserByEmail(r.Context(), link.Email)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to recover account")
+		return
+	}
+	if user == nil || user.ID != link.UserID {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidLink, "Invalid or expired link")
+		return
+	}
+
+	tokens, ok := s.startRecoverySession(w, r, user)
+	if !ok {
+		return
+	}
+	s.audit(r, user.ID, auditRecoveryLinkUsed, nil)
+
+	jsonResponse(w, struct {
+		Status string `json:"status"`
+		*sessionTokens
+	}{"ok", tokens})
+}
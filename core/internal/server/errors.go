@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// Error codes tell clients what went wrong and whether trying again can help.
+// Messages are for people and may change; codes do not.
+const (
+	codeInvalidRequest          = "invalid_request"           // malformed input, fix the request
+	codeInvalidEmail            = "invalid_email"             // not a usable email address
+	codeUnauthenticated         = "unauthenticated"           // no session, log in again
+	codeForbidden               = "forbidden"                 // signed in, but not allowed to do this
+	codeAccountDisabled         = "account_disabled"          // an administrator disabled the account
+	codeNotFound                = "not_found"                 // no such user or credential
+	codeCeremonyExpired         = "ceremony_expired"          // start the ceremony over
+	codeRegistrationFailed      = "registration_failed"       // authenticator response rejected, try again
+	codeLoginFailed             = "login_failed"              // assertion rejected, try another passkey
+	codeAuthenticatorNotAllowed = "authenticator_not_allowed" // attestation policy refused the model
+	codeCredentialSuspended     = "credential_suspended"      // possible clone, use another passkey
+	codeUsernameTaken           = "username_taken"            // choose another username
+	codeEmailTaken              = "email_taken"               // address belongs to another account
+	codeCredentialExists        = "credential_exists"         // authenticator already registered, use it to log in
+	codeLastCredential          = "last_credential"           // add another passkey first
+	codeSelfLockout             = "self_lockout"              // administrators cannot disable themselves
+	codeInvalidRecoveryCode     = "invalid_recovery_code"     // wrong username or code
+	codeInvalidLink             = "invalid_link"              // request a new link
+	codeInvalidClient           = "invalid_client"            // OpenID Connect client misconfigured
+	codeMethodNotAllowed        = "method_not_allowed"        // wrong HTTP method for the path
+	codeCSRF                    = "csrf_failed"               // fetch a token from /csrf or fix the Origin
+	codeRateLimited             = "rate_limited"              // wait for Retry-After
+	codeInternal                = "internal_error"            // server trouble, retry later
+)
+
+// errorResponse is the body of every error response
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string             `json:"code"`
+	Message   string             `json:"message"`
+	RequestID string             `json:"requestID,omitempty"`
+	WebAuthn  *webauthnErrorInfo `json:"webauthn,omitempty"`
+}
+
+// webauthnErrorInfo explains why a WebAuthn ceremony failed. It is only sent
+// when webauthn.debug is set, as it helps an attacker as much as a developer.
+type webauthnErrorInfo struct {
+	Type    string `json:"type,omitempty"`
+	Details string `json:"details"`
+	Info    string `json:"info,omitempty"`
+}
+
+// jsonError writes an error response with the given status, code and message
+func jsonError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeError(w, status, errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+}
+
+// webauthnError writes an error response for a failed WebAuthn ceremony,
+// adding the protocol error behind it in debug mode
+func (s *Server) webauthnError(w http.ResponseWriter, r *http.Request, status int, code, message string, err error) {
+	body := errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+	if s.cfg.WebAuthn.Debug && err != nil {
+		var protocolErr *protocol.Error
+		if errors.As(err, &protocolErr) {
+			body.WebAuthn = &webauthnErrorInfo{
+				Type:    protocolErr.Type,
+				Details: protocolErr.Details,
+				Info:    protocolErr.DevInfo,
+			}
+		} else {
+			body.WebAuthn = &webauthnErrorInfo{Details: err.Error()}
+		}
+	}
+	writeError(w, status, body)
+}
+
+// notFound answers requests for unknown paths
+func notFound(w http.ResponseWriter, r *http.Request) {
+	jsonError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+}
+
+// methodNotAllowed answers requests with a method the path does not support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	jsonError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, body errorBody) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: body})
+}
@@ -1,13 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"core/internal/database"
 	"core/internal/models"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 )
 
@@ -20,11 +26,23 @@ func (s *Server) BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil || req.Username == "" || req.DisplayName == "" {
 		log.Printf("Invalid request payload: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	// Create a new user
+	// Fail early on taken usernames; FinishRegistration enforces it atomically
+	existing, err := s.db.GetUserByName(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration")
+		return
+	}
+	if existing != nil {
+		jsonError(w, r, http.StatusConflict, codeUsernameTaken, "Username already taken")
+		return
+	}
+
+	// Create a new user, saved only once registration finishes
 	userID := uuid.New().String()
 	user := &models.User{
 		ID:          userID,
@@ -32,14 +50,6 @@ func (s *Server) BeginRegistration(w http.ResponseWriter, r *http.Request) {
 		DisplayName: req.DisplayName,
 	}
 
-	// Save the user to the database
-	err = s.db.SaveUser(r.Context(), user)
-	if err != nil {
-		log.Printf("Failed to save user: %v", err)
-		http.Error(w, "Failed to save user", http.StatusInternalServerError)
-		return
-	}
-
 	// Begin registration
 	options, sessionData, err := s.webAuthn.BeginRegistration(
 		user,
@@ -47,20 +57,25 @@ func (s *Server) BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	)
 	if err != nil {
 		log.Printf("Failed to begin registration: %v", err)
-		http.Error(w, "Failed to begin registration", http.StatusInternalServerError)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration", err)
 		return
 	}
 
-	// Store session data
-	s.sessionStore[userID] = sessionData
+	// Store session data along with the pending user
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData, PendingUser: user})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin registration")
+		return
+	}
 
-	// Create response with both options and userID
+	// Create response with options and ceremonyID
 	response := struct {
-		PublicKey *protocol.CredentialCreation `json:"publicKey"`
-		UserID    string                       `json:"userID"`
+		PublicKey  *protocol.CredentialCreation `json:"publicKey"`
+		CeremonyID string                       `json:"ceremonyID"`
 	}{
-		PublicKey: options,
-		UserID:    userID,
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
 	}
 
 	// Return options to client
@@ -69,112 +84,141 @@ func (s *Server) BeginRegistration(w http.ResponseWriter, r *http.Request) {
 
 // FinishRegistration completes the registration process
 func (s *Server) FinishRegistration(w http.ResponseWriter, r *http.Request) {
-	// First, get the userID from query parameter
-	userID := r.URL.Query().Get("userID")
-	if userID == "" {
-		userID = r.Header.Get("X-User-ID") // Fallback to header
+	ceremony, ok := s.takeCeremony(w, r)
+	if !ok {
+		return
 	}
 
-	if userID == "" {
-		log.Printf("UserID not provided")
-		http.Error(w, "UserID not provided", http.StatusBadRequest)
+	// Sign-up ceremonies carry the user that is about to be created
+	user := ceremony.PendingUser
+	if user == nil {
+		log.Printf("Ceremony has no pending user")
+		jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
 		return
 	}
 
-	user, err := s.db.GetUserByID(r.Context(), userID)
-	if err != nil || user == nil {
-		log.Printf("User not found: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	credential, err := s.webAuthn.FinishRegistration(user, *ceremony.Session, r)
+	if err != nil {
+		log.Printf("Failed to finish registration: %v", err)
+		s.webauthnError(w, r, http.StatusBadRequest, codeRegistrationFailed, "Failed to finish registration", err)
 		return
 	}
 
-	// Get session data
-	sessionData, ok := s.sessionStore[userID]
-	if !ok {
-		log.Printf("Session data not found for user ID: %s", userID)
-		http.Error(w, "Session data not found", http.StatusBadRequest)
+	if err := s.attestation.check(r.Context(), credential); err != nil {
+		log.Printf("Refused credential for user %s: %v", user.ID, err)
+		s.webauthnError(w, r, http.StatusForbidden, codeAuthenticatorNotAllowed, "Authenticator not allowed", err)
 		return
 	}
 
-	credential, err := s.webAuthn.FinishRegistration(user, *sessionData, r)
+	// Recovery codes are shown once, right after sign-up
+	codes, hashes, err := s.newRecoveryCodes(user.ID)
 	if err != nil {
-		log.Printf("Failed to finish registration: %v", err)
-		http.Error(w, "Failed to finish registration", http.StatusBadRequest)
+		log.Printf("Failed to generate recovery codes: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to save user")
+		return
+	}
+
+	// Save the user, their first credential and recovery codes together
+	record := newCredentialRecord(user.ID, credential)
+	err = s.db.CreateUserWithCredential(r.Context(), user, record, hashes)
+	if err != nil {
+		if errors.Is(err, database.ErrUserExists) {
+			jsonError(w, r, http.StatusConflict, codeUsernameTaken, "Username already taken")
+			return
+		}
+		if errors.Is(err, database.ErrCredentialExists) {
+			jsonError(w, r, http.StatusConflict, codeCredentialExists, "Credential already registered")
+			return
+		}
+		log.Printf("Failed to save user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to save user")
 		return
 	}
 
-	log.Printf("Credential details: %+v", credential)
+	// Log successful registration
+	log.Printf("Successfully registered credential for user %s", user.ID)
+	s.auditCredential(r, user.ID, auditUserRegistered, record, nil)
+	s.audit(r, user.ID, auditRecoveryCodesGenerated, nil)
 
-	// Extract backup flags from the credential's Flags field
-	backupEligible := false
-	// backupState := true
+	jsonResponse(w, map[string]any{"status": "ok", "recoveryCodes": codes})
+}
 
-	// Save the credential with the flags
-	cred := &models.Credential{
-		UserID:         user.ID,
+// newCredentialRecord converts a freshly registered credential into the
+// record stored for the user
+func newCredentialRecord(userID string, credential *webauthn.Credential) *models.Credential {
+	// Save the credential with the flags reported by the authenticator
+	return &models.Credential{
+		UserID:         userID,
 		PublicKey:      credential.PublicKey,
 		CredentialID:   credential.ID,
 		SignCount:      credential.Authenticator.SignCount,
 		AAGUID:         credential.Authenticator.AAGUID,
 		CloneWarning:   credential.Authenticator.CloneWarning,
 		Attachment:     credential.Authenticator.Attachment,
-		BackupEligible: backupEligible,
-		// BackupState:    backupState,
+		Transports:     credential.Transport,
+		UserPresent:    credential.Flags.UserPresent,
+		UserVerified:   credential.Flags.UserVerified,
+		BackupEligible: credential.Flags.BackupEligible,
+		BackupState:    credential.Flags.BackupState,
 	}
-
-	log.Printf("Saving credential with flags - BackupEligible: %v",
-		backupEligible)
-
-	err = s.db.SaveCredential(r.Context(), cred)
-	if err != nil {
-		log.Printf("Failed to save credential: %v", err)
-		http.Error(w, "Failed to save credential", http.StatusInternalServerError)
-		return
-	}
-
-	// Log successful registration
-	log.Printf("Successfully registered credential for user %s", user.ID)
-
-	// Clean up session data
-	delete(s.sessionStore, userID)
-
-	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
 func (s *Server) BeginLogin(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Username string `json:"username"`
+		Username  string `json:"username"`
+		Mediation string `json:"mediation"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req.Mediation == "conditional" {
+		s.beginConditionalLogin(w, r)
+		return
+	}
 	if err != nil || req.Username == "" {
 		log.Printf("Invalid request payload: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
 	user, err := s.db.GetUserByName(r.Context(), req.Username)
-	if err != nil || user == nil {
-		log.Printf("User not found: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login")
 		return
 	}
+	if user != nil && len(user.Credentials) == 0 {
+		// Nothing to log in with, so answer as for an unknown user
+		log.Printf("User %s has no passkeys to log in with", user.ID)
+		user = nil
+	}
+	if user == nil {
+		if !s.cfg.WebAuthn.HideUnknownUsers {
+			jsonError(w, r, http.StatusNotFound, codeNotFound, "User not found")
+			return
+		}
+		// Answer as a real user would be answered; the login fails at finish
+		user = s.decoyUser(req.Username)
+	}
 
 	options, sessionData, err := s.webAuthn.BeginLogin(user)
 	if err != nil {
 		log.Printf("Failed to begin login: %v", err)
-		http.Error(w, "Failed to begin login", http.StatusInternalServerError)
+		s.webauthnError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login", err)
 		return
 	}
 
-	s.sessionStore[user.ID] = sessionData
+	ceremonyID, err := s.ceremonies.Save(r.Context(), &Ceremony{Session: sessionData})
+	if err != nil {
+		log.Printf("Failed to store ceremony: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to begin login")
+		return
+	}
 
-	// Create response with both options and userID
 	response := struct {
-		PublicKey *protocol.CredentialAssertion `json:"publicKey"`
-		UserID    string                        `json:"userID"`
+		PublicKey  *protocol.CredentialAssertion `json:"publicKey"`
+		CeremonyID string                        `json:"ceremonyID"`
 	}{
-		PublicKey: options,
-		UserID:    user.ID,
+		PublicKey:  options,
+		CeremonyID: ceremonyID,
 	}
 
 	jsonResponse(w, response)
@@ -182,88 +226,267 @@ func (s *Server) BeginLogin(w http.ResponseWriter, r *http.Request) {
 
 // FinishLogin completes the login process
 func (s *Server) FinishLogin(w http.ResponseWriter, r *http.Request) {
-	// Get userID from query parameter
-	userID := r.URL.Query().Get("userID")
-	if userID == "" {
-		log.Printf("UserID not provided")
-		http.Error(w, "UserID not provided", http.StatusBadRequest)
+	ceremony, ok := s.takeCeremony(w, r)
+	if !ok {
 		return
 	}
 
-	user, err := s.db.GetUserByID(r.Context(), userID)
-	if err != nil || user == nil {
-		log.Printf("User not found: %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+	// Other ceremonies must not mint a session
+	if !ceremony.login() {
+		log.Printf("Ceremony was not begun for a login")
+		jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
 		return
 	}
 
-	sessionData, ok := s.sessionStore[user.ID]
-	if !ok {
-		log.Printf("Session data not found for user ID: %s", user.ID)
-		http.Error(w, "Session data not found", http.StatusBadRequest)
+	// Conditional ceremonies don't know the user until the browser answers
+	if ceremony.Conditional {
+		s.finishDiscoverableLogin(w, r, ceremony)
 		return
 	}
 
-	credential, err := s.webAuthn.FinishLogin(user, *sessionData, r)
+	user, err := s.db.GetUserByID(r.Context(), string(ceremony.Session.UserID))
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to finish login")
+		return
+	}
+	if user == nil {
+		// Logins begun for an unknown username end here, like a bad assertion
+		log.Printf("User not found for login ceremony")
+		jsonError(w, r, http.StatusUnauthorized, codeLoginFailed, "Failed to finish login")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		log.Printf("Failed to parse assertion: %v", err)
+		s.webauthnError(w, r, http.StatusBadRequest, codeLoginFailed, "Failed to finish login", err)
+		return
+	}
+
+	if err := s.adoptLegacyFlags(r.Context(), user, parsed); err != nil {
+		log.Printf("Failed to load credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to finish login")
+		return
+	}
+
+	// The library rejects assertions whose BE flag differs from the stored one
+	credential, err := s.webAuthn.ValidateLogin(user, *ceremony.Session, parsed)
 	if err != nil {
 		log.Printf("Login failed with detailed error: %+v", err)
-		http.Error(w, "Failed to finish login", http.StatusUnauthorized)
+		s.auditLoginFailure(r, user.ID, parsed.RawID, "invalid assertion")
+		s.webauthnError(w, r, http.StatusUnauthorized, codeLoginFailed, "Failed to finish login", err)
 		return
 	}
 
 	// Log successful validation
 	log.Printf("Successfully validated credential for user %s", user.ID)
 
+	s.completeLogin(w, r, user, credential)
+}
+
+// adoptLegacyFlags prepares the user's credentials for validating an
+// assertion. Credentials stored before authenticator flags were recorded have
+// a guessed BE flag, so the asserted one is trusted once instead; the login
+// then records it for good.
+func (s *Server) adoptLegacyFlags(ctx context.Context, user *models.User, parsed *protocol.ParsedCredentialAssertionData) error {
+	stored, err := s.db.GetCredential(ctx, parsed.RawID)
+	if err != nil || stored == nil || stored.FlagsRecorded {
+		return err
+	}
+
+	for i := range user.Credentials {
+		if bytes.Equal(user.Credentials[i].ID, parsed.RawID) {
+			user.Credentials[i].Flags.BackupEligible = parsed.Response.AuthenticatorData.Flags.HasBackupEligible()
+			log.Printf("Recording flags of credential %s on first login since they were not stored", stored.ID)
+		}
+	}
+	return nil
+}
+
+// completeLogin records the used credential and starts a session for the
+// user once an assertion has been validated
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, credential *webauthn.Credential) {
+	if user.DisabledAt != nil {
+		log.Printf("Rejected login of disabled user %s", user.ID)
+		s.auditLoginFailure(r, user.ID, credential.ID, "account disabled")
+		jsonError(w, r, http.StatusForbidden, codeAccountDisabled, "Account disabled")
+		return
+	}
+
+	stored, err := s.enforceClonePolicy(r, user, credential)
+	if err != nil {
+		if errors.Is(err, errCredentialSuspended) {
+			log.Printf("Rejected login of user %s with suspended credential", user.ID)
+			s.auditCredential(r, user.ID, auditLoginFailed, stored, map[string]any{"reason": "credential suspended"})
+			jsonError(w, r, http.StatusForbidden, codeCredentialSuspended, "Credential suspended")
+			return
+		}
+		log.Printf("Failed to check credential: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to check credential")
+		return
+	}
+
 	// Update credential's sign count and backup state
-	err = s.db.UpdateCredentialSignCount(r.Context(), credential.ID, credential.Authenticator.SignCount)
+	err = s.db.UpdateCredentialAfterLogin(r.Context(), credential.ID, credential.Authenticator.SignCount, credential.Flags)
 	if err != nil {
 		log.Printf("Failed to update credential: %v", err)
-		http.Error(w, "Failed to update credential", http.StatusInternalServerError)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to update credential")
 		return
 	}
 
-	delete(s.sessionStore, user.ID)
+	// Never carry a pre-existing session across a login
+	if _, err := s.endSession(r); err != nil {
+		log.Printf("Failed to revoke previous session: %v", err)
+	}
 
 	// Create session for authenticated user
-	sessionID := uuid.New().String()
-	s.sessionMutex.Lock()
-	s.userSessions[sessionID] = user.ID
-	s.sessionMutex.Unlock()
-
-	// Set cookie with session ID
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    sessionID,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false, // Set to true if using HTTPS
-		SameSite: http.SameSiteLaxMode,
-	})
+	token, session, err := s.sessions.Create(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create session")
+		return
+	}
+
+	tokens, err := s.issueSession(w, token, session)
+	if err != nil {
+		log.Printf("Failed to sign access token: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create session")
+		return
+	}
+	s.auditCredential(r, user.ID, auditLoginSucceeded, stored, map[string]any{"userVerified": credential.Flags.UserVerified})
+
+	jsonResponse(w, struct {
+		Status string `json:"status"`
+		*sessionTokens
+	}{"ok", tokens})
+}
+
+// Logout revokes the current session and clears its cookies
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	session, err := s.endSession(r)
+	if err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to revoke session")
+		return
+	}
+	if session != nil {
+		s.audit(r, session.UserID, auditSessionRevoked, map[string]any{"reason": "logout"})
+	}
+
+	s.clearSessionCookies(w)
 
 	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
+// setSessionCookie sets the session cookie; an empty token clears it
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	s.setPrivateCookie(w, s.cfg.Cookie.Name, token, expires)
+}
+
+// setPrivateCookie sets a cookie scripts cannot read; an empty value clears it
+func (s *Server) setPrivateCookie(w http.ResponseWriter, name, value string, expires time.Time) {
+	cookie := s.newCookie(name, value, expires)
+	cookie.HttpOnly = true
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// cookieName adds the __Host- prefix to secure host-only cookies, so that
+// browsers refuse them from plain HTTP responses and sibling subdomains
+func (s *Server) cookieName(name string) string {
+	if !s.cfg.Cookie.Secure || s.cfg.Cookie.Domain != "" || strings.HasPrefix(name, "__Host-") {
+		return name
+	}
+	return "__Host-" + name
+}
+
+// newCookie returns a cookie with the configured attributes
+func (s *Server) newCookie(name, value string, expires time.Time) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch s.cfg.Cookie.SameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return &http.Cookie{
+		Name:     s.cookieName(name),
+		Value:    value,
+		Path:     "/",
+		Domain:   s.cfg.Cookie.Domain,
+		Expires:  expires,
+		Secure:   s.cfg.Cookie.Secure,
+		SameSite: sameSite,
+	}
+}
+
 // GetCurrentUser returns the current user's information if authenticated
 func (s *Server) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	user, err := s.getUserFromSession(r)
 	if err != nil || user == nil {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
 		return
 	}
 
-	// Optionally, you may want to omit sensitive information
-	responseUser := struct {
-		ID          string `json:"id"`
-		Name        string `json:"name"`
-		DisplayName string `json:"displayName"`
-	}{
-		ID:          user.ID,
-		Name:        user.Name,
-		DisplayName: user.DisplayName,
+	jsonResponse(w, newUserResponse(user))
+}
+
+// userResponse is the public view of a user, omitting sensitive information
+type userResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	DisplayName   string `json:"displayName"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"emailVerified"`
+}
+
+func newUserResponse(user *models.User) userResponse {
+	return userResponse{
+		ID:            user.ID,
+		Name:          user.Name,
+		DisplayName:   user.DisplayName,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified != nil,
+	}
+}
+
+// ceremonyIDFromRequest returns the ceremonyID query parameter or X-Ceremony-ID header
+func ceremonyIDFromRequest(r *http.Request) string {
+	ceremonyID := r.URL.Query().Get("ceremonyID")
+	if ceremonyID == "" {
+		ceremonyID = r.Header.Get("X-Ceremony-ID") // Fallback to header
+	}
+	return ceremonyID
+}
+
+// takeCeremony loads the ceremony named by the ceremonyID query parameter (or
+// X-Ceremony-ID header) and deletes it so it cannot be finished twice. On
+// failure it writes the error response and returns false.
+func (s *Server) takeCeremony(w http.ResponseWriter, r *http.Request) (*Ceremony, bool) {
+	ceremonyID := ceremonyIDFromRequest(r)
+	if ceremonyID == "" {
+		log.Printf("CeremonyID not provided")
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "CeremonyID not provided")
+		return nil, false
+	}
+
+	ceremony, err := s.ceremonies.Take(r.Context(), ceremonyID)
+	if err != nil {
+		if errors.Is(err, ErrCeremonyNotFound) {
+			log.Printf("Session data not found for ceremony ID: %s", ceremonyID)
+			jsonError(w, r, http.StatusBadRequest, codeCeremonyExpired, "Session data not found")
+		} else {
+			log.Printf("Failed to load ceremony: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to load session data")
+		}
+		return nil, false
 	}
 
-	jsonResponse(w, responseUser)
+	return ceremony, true
 }
 
 func jsonResponse(w http.ResponseWriter, data interface{}) {
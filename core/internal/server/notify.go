@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"core/internal/mail"
+	"core/internal/models"
+)
+
+// Notifier tells users about security events on their account
+type Notifier interface {
+	// CredentialCloned reports that a credential's signature counter went
+	// backwards, and whether the credential was suspended because of it
+	CredentialCloned(ctx context.Context, user *models.User, credential *models.Credential, suspended bool) error
+}
+
+// logNotifier writes notifications to the server log
+type logNotifier struct{}
+
+func (logNotifier) CredentialCloned(ctx context.Context, user *models.User, credential *models.Credential, suspended bool) error {
+	log.Printf("Notify user %s: credential %s may have been cloned (suspended: %v)", user.ID, credential.ID, suspended)
+	return nil
+}
+
+// mailNotifier emails users who verified an address, and logs every
+// notification like logNotifier
+type mailNotifier struct {
+	mailer mail.Mailer
+}
+
+func (n mailNotifier) CredentialCloned(ctx context.Context, user *models.User, credential *models.Credential, suspended bool) error {
+	logNotifier{}.CredentialCloned(ctx, user, credential, suspended)
+	if user.EmailVerified == nil {
+		return nil
+	}
+
+	name := credential.Nickname
+	if name == "" {
+		name = "One of your passkeys"
+	}
+	action := "If you did not sign in recently from a new device, remove the passkey from your account."
+	if suspended {
+		action = "The passkey has been suspended and you have been signed out everywhere. Sign in with another passkey or a recovery code, then reinstate or remove it."
+	}
+
+	return n.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "A passkey on your account may have been copied",
+		Body: fmt.Sprintf("Hi %s,\n\n%s was just used with a signature counter that did not increase, which can mean it was copied to another device.\n\n%s\n",
+			user.DisplayName, name, action),
+	})
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"core/internal/config"
+	"core/internal/database"
+	"core/internal/models"
+)
+
+const (
+	// authorizationCodeTTL bounds how long a client may wait before redeeming a code
+	authorizationCodeTTL = time.Minute
+	// oidcTokenTTL is the lifetime of issued ID and access tokens
+	oidcTokenTTL = config.OIDCTokenTTL
+
+	idTokenType     = "JWT"
+	accessTokenType = "at+jwt"
+)
+
+// oidcAMR records that users authenticated with a hardware-bound key and a
+// user gesture, which is what a passkey login provides
+var oidcAMR = []string{"hwk", "user"}
+
+// oidcProvider turns whodis into an OpenID Connect provider on top of passkey login
+type oidcProvider struct {
+	issuer   string
+	loginURL string
+	clients  map[string]config.OIDCClient
+	keys     *signingKeys
+	stop     func()
+}
+
+// newOIDCProvider creates the provider for the configured clients
+func newOIDCProvider(ctx context.Context, db database.Service, cfg config.OIDCConfig) (*oidcProvider, error) {
+	keys, err := newSigningKeys(ctx, db, cfg.KeyRotation)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &oidcProvider{
+		issuer:   strings.TrimSuffix(cfg.Issuer, "/"),
+		loginURL: cfg.LoginURL,
+		clients:  make(map[string]config.OIDCClient, len(cfg.Clients)),
+		keys:     keys,
+	}
+	for _, client := range cfg.Clients {
+		p.clients[client.ID] = client
+	}
+
+	p.stop = startSweeper(10*time.Minute, func() {
+		if _, err := db.DeleteExpiredAuthorizationCodes(context.Background(), time.Now()); err != nil {
+			log.Printf("Failed to delete expired authorization codes: %v", err)
+		}
+	})
+	return p, nil
+}
+
+// Close stops the background sweepers
+func (p *oidcProvider) Close() error {
+	p.stop()
+	return p.keys.Close()
+}
+
+// idTokenClaims are the claims of an issued ID token
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time"`
+	AMR               []string `json:"amr"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+}
+
+// accessTokenClaims are the claims of an issued access token
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+// OIDCDiscovery serves the OpenID Provider configuration document
+func (s *Server) OIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := s.oidc.issuer
+	jsonResponse(w, map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oidc/authorize",
+		"token_endpoint":                        issuer + "/oidc/token",
+		"userinfo_endpoint":                     issuer + "/oidc/userinfo",
+		"jwks_uri":                              issuer + "/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwt.SigningMethodRS256.Alg()},
+		"scopes_supported":                      []string{"openid", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "name", "preferred_username"},
+	})
+}
+
+// OIDCJWKS serves the public keys that verify issued tokens
+func (s *Server) OIDCJWKS(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, map[string]any{"keys": s.oidc.keys.jwks()})
+}
+
+// OIDCAuthorize implements the authorization endpoint of the authorization
+// code flow. Users without a session are sent to the passkey login first.
+func (s *Server) OIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// Never redirect to an unregistered URI, so these errors are shown inline
+	client, ok := s.oidc.clients[q.Get("client_id")]
+	if !ok {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidClient, "Unknown client_id")
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidClient, "Unregistered redirect_uri")
+		return
+	}
+
+	state := q.Get("state")
+	scopes := strings.Fields(q.Get("scope"))
+	switch {
+	case q.Get("response_type") != "code":
+		redirectWithError(w, r, redirectURI, state, "unsupported_response_type", "only the code flow is supported")
+		return
+	case !slices.Contains(scopes, "openid"):
+		redirectWithError(w, r, redirectURI, state, "invalid_scope", "the openid scope is required")
+		return
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		redirectWithError(w, r, redirectURI, state, "invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	session, user, err := s.getSessionFromRequest(r)
+	if err != nil || user == nil {
+		if q.Get("prompt") == "none" {
+			redirectWithError(w, r, redirectURI, state, "login_required", "")
+			return
+		}
+
+		// Come back here once the passkey login completes
+		returnTo := s.oidc.issuer + r.URL.RequestURI()
+		http.Redirect(w, r, s.oidc.loginURL+"?return_to="+url.QueryEscape(returnTo), http.StatusFound)
+		return
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		log.Printf("Failed to generate authorization code: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to authorize")
+		return
+	}
+
+	err = s.db.SaveAuthorizationCode(r.Context(), &models.AuthorizationCode{
+		CodeHash:      hashSessionToken(code),
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		AuthTime:      session.CreatedAt,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		log.Printf("Failed to save authorization code: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to authorize")
+		return
+	}
+
+	log.Printf("Issued authorization code to client %s for user %s", client.ID, user.ID)
+
+	params := url.Values{"code": {code}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, withQuery(redirectURI, params), http.StatusFound)
+}
+
+// OIDCToken exchanges an authorization code for an ID token and access token
+func (s *Server) OIDCToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+
+	// Authenticate the client with client_secret_basic, client_secret_post or none
+	clientID, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	client, ok := s.oidc.clients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) != 1 {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	code, err := s.db.ConsumeAuthorizationCode(r.Context(), hashSessionToken(r.PostForm.Get("code")))
+	if err != nil {
+		log.Printf("Failed to load authorization code: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if code == nil || code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	// PKCE: the verifier must hash to the challenge sent to the authorization endpoint
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(verifier[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.CodeChallenge)) != 1 {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	user, err := s.db.GetUserByID(r.Context(), code.UserID)
+	if err != nil || user == nil || user.DisabledAt != nil {
+		log.Printf("User not found: %v", err)
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := jwt.NewNumericDate(now.Add(oidcTokenTTL))
+
+	idToken, err := s.oidc.keys.sign(idTokenType, idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.oidc.issuer,
+			Subject:   user.ID,
+			Audience:  jwt.ClaimStrings{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: expiresAt,
+		},
+		Nonce:             code.Nonce,
+		AuthTime:          code.AuthTime.Unix(),
+		AMR:               oidcAMR,
+		Name:              user.DisplayName,
+		PreferredUsername: user.Name,
+	})
+	if err != nil {
+		log.Printf("Failed to sign ID token: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	accessToken, err := s.oidc.keys.sign(accessTokenType, accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.oidc.issuer,
+			Subject:   user.ID,
+			Audience:  jwt.ClaimStrings{s.oidc.issuer},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: expiresAt,
+			ID:        uuid.New().String(),
+		},
+		ClientID: client.ID,
+		Scope:    code.Scope,
+	})
+	if err != nil {
+		log.Printf("Failed to sign access token: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	log.Printf("Issued tokens to client %s for user %s", client.ID, user.ID)
+
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+}
+
+// OIDCUserInfo returns the user an access token was issued for
+func (s *Server) OIDCUserInfo(w http.ResponseWriter, r *http.Request) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+
+	var claims accessTokenClaims
+	err := s.oidc.keys.parse(tokenString, accessTokenType, &claims,
+		jwt.WithIssuer(s.oidc.issuer),
+		jwt.WithAudience(s.oidc.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		log.Printf("Invalid access token: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+
+	user, err := s.db.GetUserByID(r.Context(), claims.Subject)
+	if err != nil || user == nil || user.DisabledAt != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+
+	response := struct {
+		Sub string `json:"sub"`
+		userResponse
+	}{
+		Sub:          user.ID,
+		userResponse: newUserResponse(user),
+	}
+
+	jsonResponse(w, response)
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// withQuery appends params to a URL that may already carry a query string
+func withQuery(rawURL string, params url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + params.Encode()
+	}
+	return rawURL + "?" + params.Encode()
+}
+
+// redirectWithError reports an authorization error back to the client
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, withQuery(redirectURI, params), http.StatusFound)
+}
+
+// oauthError writes an OAuth 2.0 error response
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"core/internal/config"
+	"core/internal/database"
+)
+
+// maxPeekedBody bounds how much of a request body is read to find the username
+const maxPeekedBody = 64 << 10
+
+// RateLimitStore keeps token buckets keyed by client address or username.
+// A bucket is a single timestamp, so a store shared between replicas, such
+// as Redis, can implement Take atomically with one script.
+type RateLimitStore interface {
+	// Take spends a request from every bucket, or from none if any of them is
+	// empty. It returns the longest wait until the request would be allowed,
+	// and 0 once it has been counted.
+	Take(ctx context.Context, buckets map[string]config.RateLimit) (time.Duration, error)
+
+	// Close stops the background sweeper
+	Close() error
+}
+
+// gcra applies a request at now to a bucket whose theoretical arrival time is
+// tat. It returns the new arrival time, and how long to wait if the request
+// is refused.
+func gcra(tat, now time.Time, limit config.RateLimit) (time.Time, time.Duration) {
+	if tat.Before(now) {
+		tat = now
+	}
+	slack := time.Duration(limit.Burst-1) * limit.Interval
+	if wait := tat.Sub(now) - slack; wait > 0 {
+		return tat, wait
+	}
+	return tat.Add(limit.Interval), 0
+}
+
+type memoryRateLimitStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+	stop func()
+}
+
+// NewMemoryRateLimitStore returns a process-local RateLimitStore that drops
+// refilled buckets every sweepInterval
+func NewMemoryRateLimitStore(sweepInterval time.Duration) RateLimitStore {
+	s := &memoryRateLimitStore{
+		tats: make(map[string]time.Time),
+	}
+	s.stop = startSweeper(sweepInterval, s.sweep)
+	return s
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, buckets map[string]config.RateLimit) (time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tats := make(map[string]time.Time, len(buckets))
+	var longest time.Duration
+	for bucket, limit := range buckets {
+		tat, wait := gcra(s.tats[bucket], now, limit)
+		tats[bucket] = tat
+		longest = max(longest, wait)
+	}
+	if longest > 0 {
+		return longest, nil
+	}
+	for bucket, tat := range tats {
+		s.tats[bucket] = tat
+	}
+	return 0, nil
+}
+
+func (s *memoryRateLimitStore) Close() error {
+	s.stop()
+	return nil
+}
+
+func (s *memoryRateLimitStore) sweep() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for bucket, tat := range s.tats {
+		if !tat.After(now) {
+			delete(s.tats, bucket)
+		}
+	}
+}
+
+type databaseRateLimitStore struct {
+	db   database.Service
+	stop func()
+}
+
+// NewDatabaseRateLimitStore returns a RateLimitStore backed by the
+// rate_limits table, so limits are shared between replicas
+func NewDatabaseRateLimitStore(db database.Service, sweepInterval time.Duration) RateLimitStore {
+	s := &databaseRateLimitStore{db: db}
+	s.stop = startSweeper(sweepInterval, s.sweep)
+	return s
+}
+
+func (s *databaseRateLimitStore) Take(ctx context.Context, buckets map[string]config.RateLimit) (time.Duration, error) {
+	return s.db.TakeRateLimits(ctx, buckets, time.Now())
+}
+
+func (s *databaseRateLimitStore) Close() error {
+	s.stop()
+	return nil
+}
+
+func (s *databaseRateLimitStore) sweep() {
+	n, err := s.db.DeleteExpiredRateLimits(context.Background(), time.Now())
+	if err != nil {
+		log.Printf("Failed to delete expired rate limits: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Deleted %d expired rate limits", n)
+	}
+}
+
+// RateLimitMiddleware throttles requests per client address and, when the
+// JSON body names one, per username. A request is only counted when every
+// bucket allows it; refused requests get 429 with a Retry-After header.
+func (s *Server) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buckets := make(map[string]config.RateLimit)
+		if limit := s.cfg.RateLimit.IP; limit.Burst > 0 {
+			buckets["ip:"+s.clientIP(r)] = limit
+		}
+		if limit := s.cfg.RateLimit.Username; limit.Burst > 0 {
+			if username := peekUsername(r); username != "" {
+				buckets["username:"+strings.ToLower(username)] = limit
+			}
+		}
+		if len(buckets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		wait, err := s.rateLimits.Take(r.Context(), buckets)
+		if err != nil {
+			// Keep serving logins when the store is down
+			log.Printf("Failed to check rate limit: %v", err)
+		} else if wait > 0 {
+			log.Printf("Rate limited %s %s from %s", r.Method, r.URL.Path, s.clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			jsonError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peekUsername returns the username field of a JSON request body, leaving
+// the body intact for the handler
+func peekUsername(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxPeekedBody))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+
+	var body struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(head, &body) != nil {
+		return ""
+	}
+	return body.Username
+}
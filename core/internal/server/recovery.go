@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"core/internal/models"
+)
+
+const (
+	// recoveryCodeCount is how many codes a user gets at a time
+	recoveryCodeCount = 10
+	// recoveryCodeAlphabet is Crockford's base32, which avoids look-alike letters
+	recoveryCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// recoveryCodeLength is the number of characters in a code, 5 bits each
+	recoveryCodeLength = 16
+	// recoveryCodeGroup is how many characters are shown between dashes
+	recoveryCodeGroup = 4
+)
+
+// recoverySecretName names the server secret recovery codes are hashed with
+const recoverySecretName = "recovery-code"
+
+// newRecoveryCodes returns fresh recovery codes for the user formatted for
+// display and the hashes to store for them
+func (s *Server) newRecoveryCodes(userID string) ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		var code strings.Builder
+		for j := range b {
+			if j > 0 && j%recoveryCodeGroup == 0 {
+				code.WriteByte('-')
+			}
+			code.WriteByte(recoveryCodeAlphabet[b[j]%32])
+		}
+		codes[i] = code.String()
+		hashes[i] = s.hashRecoveryCode(userID, codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode derives the stored hash of a user's code as typed,
+// ignoring case, separators and look-alike letters. It is keyed with a server
+// secret, so a copy of the recovery codes alone cannot be brute-forced.
+func (s *Server) hashRecoveryCode(userID, code string) string {
+	normalized := strings.Map(func(c rune) rune {
+		switch c {
+		case '-', ' ':
+			return -1
+		case 'O':
+			return '0'
+		case 'I', 'L':
+			return '1'
+		}
+		return c
+	}, strings.ToUpper(code))
+
+	h := hmac.New(sha256.New, s.recoverySecret)
+	h.Write([]byte(userID))
+	h.Write([]byte{0})
+	h.Write([]byte(normalized))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sessionFromContext returns the session stored by AuthMiddleware
+func sessionFromContext(r *http.Request) *models.Session {
+	session, _ := r.Context().Value("session").(*models.Session)
+	return session
+}
+
+// Recover consumes a recovery code and starts a recovery session, which may
+// only be used to enroll a new passkey
+func (s *Server) Recover(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Code     string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Username == "" || req.Code == "" {
+		jsonError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	user, err := s.db.GetUserByName(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to recover account")
+		return
+	}
+
+	consumed := false
+	if user != nil && user.DisabledAt != nil {
+		// Keep the code for when the account is enabled again
+		s.audit(r, user.ID, auditRecoveryFailed, map[string]any{"reason": "account disabled"})
+		user = nil
+	}
+	if user != nil {
+		consumed, err = s.db.ConsumeRecoveryCode(r.Context(), user.ID, s.hashRecoveryCode(user.ID, req.Code))
+		if err != nil {
+			log.Printf("Failed to consume recovery code: %v", err)
+			jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to recover account")
+			return
+		}
+	}
+	if !consumed {
+		if user != nil {
+			s.audit(r, user.ID, auditRecoveryFailed, nil)
+		}
+		// Unknown users and wrong codes look the same
+		jsonError(w, r, http.StatusUnauthorized, codeInvalidRecoveryCode, "Invalid username or recovery code")
+		return
+	}
+
+	tokens, ok := s.startRecoverySession(w, r, user)
+	if !ok {
+		return
+	}
+
+	remaining, err := s.db.CountRecoveryCodes(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to count recovery codes: %v", err)
+	}
+	s.audit(r, user.ID, auditRecoveryCodeUsed, map[string]any{"remaining": remaining})
+
+	jsonResponse(w, struct {
+		Status         string `json:"status"`
+		RemainingCodes int    `json:"remainingCodes"`
+		*sessionTokens
+	}{"ok", remaining, tokens})
+}
+
+// startRecoverySession replaces any session the request carries with a
+// recovery session for the user, returning its tokens in token mode. On
+// failure it writes the error response and returns false.
+func (s *Server) startRecoverySession(w http.ResponseWriter, r *http.Request, user *models.User) (*sessionTokens, bool) {
+	if user.DisabledAt != nil {
+		jsonError(w, r, http.StatusForbidden, codeAccountDisabled, "Account disabled")
+		return nil, false
+	}
+
+	// Never carry a pre-existing session across a recovery
+	if _, err := s.endSession(r); err != nil {
+		log.Printf("Failed to revoke previous session: %v", err)
+	}
+
+	token, session, err := s.sessions.CreateRecovery(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create session")
+		return nil, false
+	}
+	tokens, err := s.issueSession(w, token, session)
+	if err != nil {
+		log.Printf("Failed to sign access token: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create session")
+		return nil, false
+	}
+	return tokens, true
+}
+
+// rotateSession replaces the session of the request with a new one of the
+// given scope and hands it to the client, returning its tokens in token mode
+func (s *Server) rotateSession(w http.ResponseWriter, r *http.Request, scope string) (*sessionTokens, error) {
+	session := sessionFromContext(r)
+	if session == nil {
+		return nil, nil
+	}
+	token, rotated, err := s.sessions.Rotate(r.Context(), session, scope)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueSession(w, token, rotated)
+}
+
+// GetRecoveryCodes reports how many unused recovery codes the signed-in user has
+func (s *Server) GetRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	remaining, err := s.db.CountRecoveryCodes(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to count recovery codes: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to count recovery codes")
+		return
+	}
+
+	jsonResponse(w, map[string]int{"remaining": remaining})
+}
+
+// RegenerateRecoveryCodes replaces the signed-in user's recovery codes. The
+// new codes are returned once and cannot be retrieved later.
+func (s *Server) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r)
+
+	codes, hashes, err := s.newRecoveryCodes(user.ID)
+	if err != nil {
+		log.Printf("Failed to generate recovery codes: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to generate recovery codes")
+		return
+	}
+
+	if err := s.db.ReplaceRecoveryCodes(r.Context(), user.ID, hashes); err != nil {
+		log.Printf("Failed to save recovery codes: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to generate recovery codes")
+		return
+	}
+	s.audit(r, user.ID, auditRecoveryCodesGenerated, nil)
+
+	jsonResponse(w, map[string][]string{"recoveryCodes": codes})
+}
@@ -12,29 +12,108 @@ import (
 
 func (s *Server) RegisterRoutes() http.Handler {
 	r := chi.NewRouter()
+	// Error responses carry the request ID the log line is tagged with
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
+	r.NotFound(notFound)
+	r.MethodNotAllowed(methodNotAllowed)
 
 	// Add CORS middleware
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"}, // Your frontend origin
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
+		AllowedOrigins:   s.cfg.CORS.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", csrfHeader},
+		ExposedHeaders:   []string{"Retry-After"},
 		AllowCredentials: true, // Important for cookies
-		MaxAge:           300,  // Maximum value not ignored by any of major browsers
+		MaxAge:           s.cfg.CORS.MaxAge,
 	}))
 
 	r.Get("/", s.HelloWorldHandler)
 
-	// Registration endpoints
-	r.Post("/register/begin", s.BeginRegistration)
-	r.Post("/register/finish", s.FinishRegistration)
+	// OpenID Connect provider; its POST endpoints authenticate relying
+	// parties rather than browsers, so they are not checked for CSRF
+	r.Get("/.well-known/openid-configuration", s.OIDCDiscovery)
+	r.Get("/oidc/jwks", s.OIDCJWKS)
+	r.Get("/oidc/authorize", s.OIDCAuthorize)
+	r.Post("/oidc/token", s.OIDCToken)
+	r.Get("/oidc/userinfo", s.OIDCUserInfo)
+	r.Post("/oidc/userinfo", s.OIDCUserInfo)
 
-	// Login endpoints
-	r.Post("/login/begin", s.BeginLogin)
-	r.Post("/login/finish", s.FinishLogin)
+	// Renewing access tokens, which are verified against /oidc/jwks
+	if s.tokenSessions() {
+		r.Post("/session/refresh", s.RefreshSession)
+	}
+
+	// Everything a browser calls with the session cookie refuses
+	// cross-site writes
+	r.Group(func(r chi.Router) {
+		r.Use(s.CSRFMiddleware)
+		r.Get("/csrf", s.CSRFToken)
+
+		// Unauthenticated ceremonies are throttled per address and username
+		r.Group(func(r chi.Router) {
+			r.Use(s.RateLimitMiddleware)
+
+			// Registration endpoints
+			r.Post("/register/begin", s.BeginRegistration)
+			r.Post("/register/finish", s.FinishRegistration)
+
+			// Login endpoints
+			r.Post("/login/begin", s.BeginLogin)
+			r.Post("/login/finish", s.FinishLogin)
+			r.Post("/login/cancel", s.CancelLogin)
+			r.Post("/login/discoverable/begin", s.BeginDiscoverableLogin)
+			r.Post("/login/discoverable/finish", s.FinishDiscoverableLogin)
+
+			// Account recovery
+			r.Post("/recover", s.Recover)
+			r.Post("/recover/email", s.BeginEmailRecovery)
+			r.Post("/recover/email/finish", s.FinishEmailRecovery)
+			r.Post("/email/verify", s.VerifyEmail)
+		})
+		r.Post("/logout", s.Logout)
+
+		// Protected endpoint
+		r.With(s.AuthMiddleware).Get("/me", s.GetCurrentUser)
+
+		// Credential management for signed-in users
+		// Enrolling a passkey is also how a recovery session gets back in
+		r.Group(func(r chi.Router) {
+			r.Use(s.RecoveryAuthMiddleware)
+			r.Post("/credentials/register/begin", s.BeginAddCredential)
+			r.Post("/credentials/register/finish", s.FinishAddCredential)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.AuthMiddleware)
+			r.Get("/me/credentials", s.ListCredentials)
+			r.Patch("/me/credentials/{id}", s.RenameCredential)
+			r.Delete("/me/credentials/{id}", s.DeleteCredential)
+			r.Post("/me/credentials/{id}/reinstate/begin", s.BeginReinstateCredential)
+			r.Post("/me/credentials/{id}/reinstate", s.ReinstateCredential)
+
+			r.Put("/me/email", s.SetEmail)
+
+			r.Get("/me/activity", s.GetActivity)
+
+			r.Get("/me/recovery-codes", s.GetRecoveryCodes)
+			r.Post("/me/recovery-codes", s.RegenerateRecoveryCodes)
+		})
 
-	// Protected endpoint
-	r.With(s.AuthMiddleware).Get("/me", s.GetCurrentUser)
+		// Account management for operators
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.AuthMiddleware, s.AdminMiddleware)
+			r.Get("/users", s.AdminListUsers)
+			r.Get("/users/{id}", s.AdminGetUser)
+			r.Post("/users/{id}/disable", s.AdminDisableUser)
+			r.Post("/users/{id}/enable", s.AdminEnableUser)
+			r.Delete("/users/{id}/credentials/{credentialID}", s.AdminDeleteCredential)
+			r.Post("/users/{id}/credentials/{credentialID}/reinstate", s.AdminReinstateCredential)
+			r.Delete("/users/{id}/sessions", s.AdminRevokeSessions)
+			r.Delete("/users/{id}/sessions/{sessionID}", s.AdminRevokeSession)
+			r.Get("/audit", s.AdminListAuditEvents)
+		})
+	})
 
 	return r
 }
@@ -2,104 +2,239 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
-	"sync"
+	"net/netip"
 	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
-	_ "github.com/joho/godotenv/autoload"
 
+	"core/internal/aaguid"
+	"core/internal/config"
 	"core/internal/database"
+	"core/internal/mail"
 	"core/internal/models"
 )
 
 type Server struct {
 	port int
+	cfg  *config.Config
 	db   database.Service
 
-	webAuthn     *webauthn.WebAuthn
-	sessionStore map[string]*webauthn.SessionData
+	webAuthn   *webauthn.WebAuthn
+	ceremonies CeremonyStore
 
-	userSessions map[string]string
-	sessionMutex sync.RWMutex
+	sessions *SessionService
+	notifier Notifier
+	oidc     *oidcProvider
+
+	attestation    *attestationPolicy
+	authenticators *aaguid.Catalog
+	links          *magicLinks
+	rateLimits     RateLimitStore
+	trustedProxies []netip.Prefix
+	decoySecret    []byte
+	recoverySecret []byte
 }
 
-func NewServer() *http.Server {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	dbService := database.New()
+func NewServer(cfg *config.Config) *http.Server {
+	dbService := database.New(cfg.Database)
+
+	// Ask authenticators for discoverable credentials when configured
+	residentKey := protocol.ResidentKeyRequirement(cfg.WebAuthn.ResidentKey)
+
+	// Load trust anchors and metadata before accepting registrations
+	attestation, err := newAttestationPolicy(cfg.Attestation)
+	if err != nil {
+		log.Fatalf("Failed to load attestation policy: %v", err)
+	}
+
+	// Name authenticator models for credential listings
+	authenticators, err := aaguid.Load(cfg.WebAuthn.AuthenticatorCatalog)
+	if err != nil {
+		log.Fatalf("Failed to load authenticator catalog: %v", err)
+	}
 
 	// Initialize WebAuthn with correct config
 	wconfig := &webauthn.Config{
-		RPDisplayName: "My App",
-		RPID:          "localhost",
-		RPOrigins:     []string{"http://localhost:3000"},
+		RPDisplayName: cfg.WebAuthn.RPDisplayName,
+		RPID:          cfg.WebAuthn.RPID,
+		RPOrigins:     cfg.WebAuthn.RPOrigins,
 		AuthenticatorSelection: protocol.AuthenticatorSelection{
-			RequireResidentKey: &[]bool{false}[0],
+			RequireResidentKey: &[]bool{residentKey == protocol.ResidentKeyRequirementRequired}[0],
+			ResidentKey:        residentKey,
 			UserVerification:   protocol.VerificationPreferred,
 		},
-		AttestationPreference: protocol.PreferNoAttestation,
-		Debug:                 true, // Enable debug logging
+		AttestationPreference: protocol.ConveyancePreference(cfg.Attestation.Conveyance),
+		MDS:                   attestation.mds,
+		Debug:                 cfg.WebAuthn.Debug,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: cfg.WebAuthn.Timeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: cfg.WebAuthn.Timeout},
+		},
 	}
 	webAuthn, err := webauthn.New(wconfig)
 	if err != nil {
 		log.Fatalf("Failed to create WebAuthn from config: %v", err)
 	}
 
+	// Choose where in-flight ceremonies are kept
+	var ceremonies CeremonyStore
+	if cfg.Ceremony.Store == "memory" {
+		ceremonies = NewMemoryCeremonyStore(time.Minute)
+	} else {
+		ceremonies = NewDatabaseCeremonyStore(dbService, time.Minute)
+	}
+
+	// Choose where rate limits are counted
+	var rateLimits RateLimitStore
+	if cfg.RateLimit.Store == "memory" {
+		rateLimits = NewMemoryRateLimitStore(time.Minute)
+	} else {
+		rateLimits = NewDatabaseRateLimitStore(dbService, time.Minute)
+	}
+
+	// Issue OpenID Connect tokens on top of passkey login
+	oidc, err := newOIDCProvider(context.Background(), dbService, cfg.OIDC)
+	if err != nil {
+		log.Fatalf("Failed to create OIDC provider: %v", err)
+	}
+
+	// Send magic links signed with the OIDC keys
+	mailer, err := mail.New(cfg.Email)
+	if err != nil {
+		log.Fatalf("Failed to create mailer: %v", err)
+	}
+	links := newMagicLinks(dbService, mailer, oidc.keys, oidc.issuer, cfg.Email)
+
+	// Derive decoy challenges from a secret of their own
+	decoySecret, err := loadServerSecret(context.Background(), dbService, decoySecretName)
+	if err != nil {
+		log.Fatalf("Failed to load decoy secret: %v", err)
+	}
+
+	// Key recovery code hashes, so a database copy alone cannot crack them
+	recoverySecret, err := loadServerSecret(context.Background(), dbService, recoverySecretName)
+	if err != nil {
+		log.Fatalf("Failed to load recovery code secret: %v", err)
+	}
+
+	// Believe forwarding headers from these proxies only
+	var trustedProxies []netip.Prefix
+	for _, proxy := range cfg.Server.TrustedProxies {
+		prefix, err := config.ParseTrustedProxy(proxy)
+		if err != nil {
+			log.Fatalf("Failed to parse trusted proxy: %v", err)
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
 	NewServer := &Server{
-		port:         port,
-		db:           dbService,
-		webAuthn:     webAuthn,
-		sessionStore: make(map[string]*webauthn.SessionData),
-		userSessions: make(map[string]string),
+		port:       cfg.Server.Port,
+		cfg:        cfg,
+		db:         dbService,
+		webAuthn:   webAuthn,
+		ceremonies: ceremonies,
+		sessions:   NewSessionService(dbService, cfg.Session.IdleTimeout, cfg.Session.AbsoluteTimeout),
+		notifier:   mailNotifier{mailer: mailer},
+		oidc:       oidc,
+
+		attestation:    attestation,
+		authenticators: authenticators,
+		links:          links,
+		rateLimits:     rateLimits,
+		trustedProxies: trustedProxies,
+		decoySecret:    decoySecret,
+		recoverySecret: recoverySecret,
 	}
 
 	// Declare Server config
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
 		Handler:      NewServer.RegisterRoutes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
 	}
+	server.RegisterOnShutdown(func() {
+		ceremonies.Close()
+		NewServer.sessions.Close()
+		oidc.Close()
+		links.Close()
+		rateLimits.Close()
+	})
 
 	return server
 }
 
-func (s *Server) getUserFromSession(r *http.Request) (*models.User, error) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil {
-		return nil, fmt.Errorf("No session cookie")
+// loadServerSecret returns the named random secret, generating it on first
+// start. Every replica ends up with the one stored first.
+func loadServerSecret(ctx context.Context, db database.Service, name string) ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
 	}
-	sessionID := cookie.Value
+	return db.GetOrCreateServerSecret(ctx, name, secret)
+}
 
-	s.sessionMutex.RLock()
-	userID, ok := s.userSessions[sessionID]
-	s.sessionMutex.RUnlock()
-	if !ok {
-		return nil, fmt.Errorf("Invalid session ID")
+// getSessionFromRequest returns the full session the request carries.
+// Recovery sessions are refused.
+func (s *Server) getSessionFromRequest(r *http.Request) (*models.Session, *models.User, error) {
+	return s.sessionFromRequest(r, false)
+}
+
+func (s *Server) sessionFromRequest(r *http.Request, allowRecovery bool) (*models.Session, *models.User, error) {
+	token := s.requestSessionToken(r)
+	if token == "" {
+		return nil, nil, fmt.Errorf("No session token")
 	}
 
-	user, err := s.db.GetUserByID(r.Context(), userID)
+	session, err := s.lookupSession(r.Context(), token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid session: %w", err)
+	}
+	if session.Scope == sessionScopeRecovery && !allowRecovery {
+		return nil, nil, fmt.Errorf("Recovery session")
+	}
+
+	user, err := s.db.GetUserByID(r.Context(), session.UserID)
 	if err != nil || user == nil {
-		return nil, fmt.Errorf("User not found")
+		return nil, nil, fmt.Errorf("User not found")
 	}
-	return user, nil
+	if user.DisabledAt != nil {
+		return nil, nil, fmt.Errorf("Account disabled")
+	}
+	return session, user, nil
+}
+
+func (s *Server) getUserFromSession(r *http.Request) (*models.User, error) {
+	_, user, err := s.getSessionFromRequest(r)
+	return user, err
 }
 
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
+	return s.authenticate(next, false)
+}
+
+// RecoveryAuthMiddleware also admits recovery sessions, for the endpoints
+// that enroll a new passkey
+func (s *Server) RecoveryAuthMiddleware(next http.Handler) http.Handler {
+	return s.authenticate(next, true)
+}
+
+func (s *Server) authenticate(next http.Handler, allowRecovery bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, err := s.getUserFromSession(r)
+		session, user, err := s.sessionFromRequest(r, allowRecovery)
 		if err != nil || user == nil {
-			http.Error(w, "Not authenticated", http.StatusUnauthorized)
+			jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "user", user)
+		ctx = context.WithValue(ctx, "session", session)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
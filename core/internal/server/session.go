@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"core/internal/database"
+	"core/internal/models"
+)
+
+// sessionTouchInterval limits how often activity is written back to the database
+const sessionTouchInterval = time.Minute
+
+const (
+	// sessionScopeRecovery marks sessions started with a recovery code, which
+	// may only enroll a new passkey
+	sessionScopeRecovery = "recovery"
+	// recoverySessionLifetime bounds how long a recovery session lasts
+	recoverySessionLifetime = 15 * time.Minute
+)
+
+var (
+	// ErrSessionNotFound is returned for unknown or revoked session tokens
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionExpired is returned once a session hit its idle or absolute timeout
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// SessionService manages server-side authenticated sessions. Clients only
+// ever hold the session token; the database stores its SHA-256 hash.
+type SessionService struct {
+	db              database.Service
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	stop            func()
+}
+
+// NewSessionService returns a SessionService enforcing the given timeouts
+func NewSessionService(db database.Service, idleTimeout, absoluteTimeout time.Duration) *SessionService {
+	s := &SessionService{
+		db:              db,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+	}
+	s.stop = startSweeper(10*time.Minute, s.sweep)
+	return s
+}
+
+// hashSessionToken derives the stored session ID from a client token
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create starts a new session for the user and returns its token
+func (s *SessionService) Create(ctx context.Context, userID string) (string, *models.Session, error) {
+	return s.create(ctx, userID, "", s.absoluteTimeout)
+}
+
+// CreateRecovery starts a short recovery session for the user
+func (s *SessionService) CreateRecovery(ctx context.Context, userID string) (string, *models.Session, error) {
+	return s.create(ctx, userID, sessionScopeRecovery, recoverySessionLifetime)
+}
+
+func (s *SessionService) create(ctx context.Context, userID, scope string, lifetime time.Duration) (string, *models.Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	session := &models.Session{
+		ID:         hashSessionToken(token),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(lifetime),
+		Scope:      scope,
+	}
+	if err := s.db.CreateSession(ctx, session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// Lookup returns the active session for a token
+func (s *SessionService) Lookup(ctx context.Context, token string) (*models.Session, error) {
+	return s.LookupID(ctx, hashSessionToken(token))
+}
+
+// LookupID returns the active session with the given ID, as named by the
+// access tokens of token session mode
+func (s *SessionService) LookupID(ctx context.Context, id string) (*models.Session, error) {
+	session, err := s.db.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.RevokedAt != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	now := time.Now()
+	if !session.ExpiresAt.After(now) || !session.LastSeenAt.Add(s.idleTimeout).After(now) {
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+// Touch records activity on the session, extending its idle timeout
+func (s *SessionService) Touch(ctx context.Context, session *models.Session) error {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	if err := s.db.TouchSession(ctx, session.ID, now); err != nil {
+		return err
+	}
+	session.LastSeenAt = now
+	return nil
+}
+
+// Revoke ends the session identified by the token
+func (s *SessionService) Revoke(ctx context.Context, token string) error {
+	return s.db.RevokeSession(ctx, hashSessionToken(token))
+}
+
+// RevokeAllForUser ends every session belonging to the user
+func (s *SessionService) RevokeAllForUser(ctx context.Context, userID string) error {
+	n, err := s.db.RevokeUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked %d sessions for user %s", n, userID)
+	return nil
+}
+
+// Rotate replaces the session with one of the given scope under a new token.
+// Call it whenever the privileges attached to a session change, so a token
+// captured before the change is worthless after it. The login time and expiry
+// carry over, so rotating never extends the absolute timeout. It returns
+// ErrSessionNotFound if the session was revoked meanwhile.
+func (s *SessionService) Rotate(ctx context.Context, session *models.Session, scope string) (string, *models.Session, error) {
+	return s.replace(ctx, session, scope)
+}
+
+// Refresh replaces the session with one under a new token, so a refresh token
+// works only once. The login time and expiry carry over. It returns
+// ErrSessionNotFound if the session was refreshed or revoked meanwhile.
+func (s *SessionService) Refresh(ctx context.Context, session *models.Session) (string, *models.Session, error) {
+	return s.replace(ctx, session, session.Scope)
+}
+
+// replace revokes the session and stores its successor in one transaction
+func (s *SessionService) replace(ctx context.Context, session *models.Session, scope string) (string, *models.Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	replacement := &models.Session{
+		ID:         hashSessionToken(token),
+		UserID:     session.UserID,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: time.Now(),
+		ExpiresAt:  session.ExpiresAt,
+		Scope:      scope,
+	}
+	err := s.db.ReplaceSession(ctx, session.ID, replacement)
+	if errors.Is(err, database.ErrSessionRevoked) {
+		return "", nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return token, replacement, nil
+}
+
+// Close stops the background sweeper
+func (s *SessionService) Close() error {
+	s.stop()
+	return nil
+}
+
+func (s *SessionService) sweep() {
+	now := time.Now()
+	n, err := s.db.DeleteExpiredSessions(context.Background(), now.Add(-s.idleTimeout), now)
+	if err != nil {
+		log.Printf("Failed to delete expired sessions: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Deleted %d expired sessions", n)
+	}
+}
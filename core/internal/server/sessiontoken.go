@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"core/internal/models"
+)
+
+const (
+	// sessionTokenType is the typ header of session access tokens, which
+	// keeps them apart from OpenID Connect tokens signed by the same keys
+	sessionTokenType = "session+jwt"
+	// refreshCookie holds the refresh token in token session mode
+	refreshCookie = "refresh_token"
+)
+
+// sessionClaims are the claims of a session access token. Services holding
+// the JWKS verify them without calling whodis, so for them revoking the
+// session only takes effect when the token expires; whodis itself checks the
+// session on every request.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	SessionID string           `json:"sid"`
+	Scope     string           `json:"scope,omitempty"`
+	AuthTime  *jwt.NumericDate `json:"auth_time,omitempty"` // when the user logged in
+}
+
+// sessionTokens are handed to clients when a session starts or is refreshed
+// in token mode, for those that send Authorization: Bearer
+type sessionTokens struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// tokenSessions reports whether sessions are carried by signed access tokens
+func (s *Server) tokenSessions() bool {
+	return s.cfg.Session.Mode == "token"
+}
+
+// signSessionToken issues an access token for the session, expiring no later
+// than the session itself
+func (s *Server) signSessionToken(session *models.Session) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.cfg.Session.AccessTokenTTL)
+	if session.ExpiresAt.Before(expiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+
+	token, err := s.oidc.keys.sign(sessionTokenType, sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.oidc.issuer,
+			Subject:   session.UserID,
+			Audience:  jwt.ClaimStrings{s.oidc.issuer},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		SessionID: session.ID,
+		Scope:     session.Scope,
+		AuthTime:  jwt.NewNumericDate(session.CreatedAt),
+	})
+	return token, expiresAt, err
+}
+
+// parseSessionToken verifies an access token and returns the session it was
+// issued for
+func (s *Server) parseSessionToken(token string) (*models.Session, error) {
+	var claims sessionClaims
+	err := s.oidc.keys.parse(token, sessionTokenType, &claims,
+		jwt.WithIssuer(s.oidc.issuer),
+		jwt.WithAudience(s.oidc.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.AuthTime == nil {
+		return nil, errors.New("access token has no auth_time")
+	}
+	return &models.Session{
+		ID:        claims.SessionID,
+		UserID:    claims.Subject,
+		CreatedAt: claims.AuthTime.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+		Scope:     claims.Scope,
+	}, nil
+}
+
+// bearerToken returns the token of a Bearer Authorization header, or "" if
+// the request has none
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requestSessionToken returns the bearer token of the request, or else its
+// session cookie
+func (s *Server) requestSessionToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(s.cookieName(s.cfg.Cookie.Name)); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// lookupSession returns the active session for a token the client presented:
+// a signed access token in token mode, a session token in server mode
+func (s *Server) lookupSession(ctx context.Context, token string) (*models.Session, error) {
+	if s.tokenSessions() {
+		session, err := s.parseSessionToken(token)
+		if err != nil {
+			return nil, err
+		}
+		// The token outlives a logout, revocation or refresh of its session
+		stored, err := s.sessions.LookupID(ctx, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.sessions.Touch(ctx, stored); err != nil {
+			log.Printf("Failed to touch session: %v", err)
+		}
+		return session, nil
+	}
+
+	session, err := s.sessions.Lookup(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.sessions.Touch(ctx, session); err != nil {
+		log.Printf("Failed to touch session: %v", err)
+	}
+	return session, nil
+}
+
+// issueSession hands a new session to the client. In server mode its token
+// becomes the session cookie. In token mode the session cookie holds an
+// access token and the session token becomes the refresh token; both are
+// also returned for the response body.
+func (s *Server) issueSession(w http.ResponseWriter, token string, session *models.Session) (*sessionTokens, error) {
+	if !s.tokenSessions() {
+		s.setSessionCookie(w, token, session.ExpiresAt)
+		return nil, nil
+	}
+
+	accessToken, expiresAt, err := s.signSessionToken(session)
+	if err != nil {
+		return nil, err
+	}
+	s.setSessionCookie(w, accessToken, expiresAt)
+	s.setPrivateCookie(w, refreshCookie, token, session.ExpiresAt)
+
+	return &sessionTokens{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expiresAt).Seconds()),
+		RefreshToken: token,
+	}, nil
+}
+
+// endSession revokes the session the request carries, if any, and returns it
+func (s *Server) endSession(r *http.Request) (*models.Session, error) {
+	var session *models.Session
+	if token := s.requestSessionToken(r); token != "" {
+		session, _ = s.lookupSession(r.Context(), token)
+	}
+	// The refresh token outlives its access token
+	if cookie, err := r.Cookie(s.cookieName(refreshCookie)); err == nil && s.tokenSessions() {
+		if refreshed, _ := s.sessions.Lookup(r.Context(), cookie.Value); refreshed != nil {
+			session = refreshed
+		}
+	}
+	if session == nil {
+		return nil, nil
+	}
+	return session, s.db.RevokeSession(r.Context(), session.ID)
+}
+
+// clearSessionCookies removes the session and refresh cookies
+func (s *Server) clearSessionCookies(w http.ResponseWriter) {
+	s.setSessionCookie(w, "", time.Time{})
+	if s.tokenSessions() {
+		s.setPrivateCookie(w, refreshCookie, "", time.Time{})
+	}
+}
+
+// RefreshSession issues a new access token and refresh token for the session
+// named by a refresh token, taken from the JSON body or the refresh_token
+// cookie. A forged
+// cross-site refresh gains nothing, as the caller cannot read the response,
+// so like the OpenID Connect token endpoint it is not checked for CSRF.
+func (s *Server) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	// Browsers send only the cookie
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	token := req.RefreshToken
+	if cookie, err := r.Cookie(s.cookieName(refreshCookie)); err == nil && token == "" {
+		token = cookie.Value
+	}
+	if token == "" {
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+
+	session, err := s.sessions.Lookup(r.Context(), token)
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		s.clearSessionCookies(w)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to refresh session")
+		return
+	}
+
+	user, err := s.db.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to refresh session")
+		return
+	}
+	if user == nil || user.DisabledAt != nil {
+		s.clearSessionCookies(w)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+
+	// Each refresh token works once
+	token, session, err = s.sessions.Refresh(r.Context(), session)
+	if errors.Is(err, ErrSessionNotFound) {
+		s.clearSessionCookies(w)
+		jsonError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Not authenticated")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to refresh session: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to refresh session")
+		return
+	}
+	tokens, err := s.issueSession(w, token, session)
+	if err != nil {
+		log.Printf("Failed to sign access token: %v", err)
+		jsonError(w, r, http.StatusInternalServerError, codeInternal, "Failed to refresh session")
+		return
+	}
+
+	jsonResponse(w, tokens)
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"core/internal/config"
+	"core/internal/database"
+	"core/internal/models"
+)
+
+const (
+	// signingKeyBits is the size of generated RSA signing keys
+	signingKeyBits = 2048
+	// signingKeyActivation holds a new key back from signing until every
+	// replica has loaded it and can verify its tokens
+	signingKeyActivation = config.SigningKeyActivation
+	// signingKeyReload is how often keys added by other replicas are picked
+	// up, twice per activation delay
+	signingKeyReload = signingKeyActivation / 2
+)
+
+// signingKey is a loaded token signing key
+type signingKey struct {
+	id        string
+	private   *rsa.PrivateKey
+	createdAt time.Time
+}
+
+// signingKeys holds the RS256 keys used to sign tokens. The newest active key
+// signs. A key it replaced stays in the JWKS for one more rotation period, so
+// tokens signed by it still verify; older keys are no longer published.
+type signingKeys struct {
+	db       database.Service
+	rotation time.Duration
+	stop     func()
+
+	mu   sync.RWMutex
+	keys []*signingKey // newest first
+}
+
+// newSigningKeys loads the stored signing keys, generating the first one if
+// none exist yet, and generates another every rotation
+func newSigningKeys(ctx context.Context, db database.Service, rotation time.Duration) (*signingKeys, error) {
+	k := &signingKeys{db: db, rotation: rotation}
+	if err := k.load(ctx); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		if err := k.generate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	k.stop = startSweeper(signingKeyReload, k.rotate)
+	return k, nil
+}
+
+// Close stops the background rotation
+func (k *signingKeys) Close() error {
+	k.stop()
+	return nil
+}
+
+// rotate picks up keys other replicas generated, generates a new key if
+// there is none or the newest is due for rotation, and deletes the keys that
+// are no longer published
+func (k *signingKeys) rotate() {
+	ctx := context.Background()
+	if err := k.load(ctx); err != nil {
+		log.Printf("Failed to reload signing keys: %v", err)
+		return
+	}
+
+	k.mu.RLock()
+	due := len(k.keys) == 0 || k.rotation > 0 && time.Since(k.keys[0].createdAt) >= k.rotation
+	k.mu.RUnlock()
+	if due {
+		if err := k.generate(ctx); err != nil {
+			log.Printf("Failed to generate signing key: %v", err)
+			return
+		}
+		log.Printf("Generated a new signing key, signing with it in %s", signingKeyActivation)
+	}
+
+	k.prune(ctx)
+}
+
+// prune deletes the keys older than every published one, as no token signed
+// by them verifies any more
+func (k *signingKeys) prune(ctx context.Context) {
+	k.mu.RLock()
+	published := k.published()
+	stale := len(published) < len(k.keys)
+	oldest := published[len(published)-1].createdAt
+	k.mu.RUnlock()
+	if !stale {
+		return
+	}
+
+	n, err := k.db.DeleteSigningKeys(ctx, oldest)
+	if err != nil {
+		log.Printf("Failed to delete retired signing keys: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Deleted %d retired signing keys", n)
+	}
+}
+
+// active returns the key to sign with: the newest one every replica knows,
+// or the oldest if none is that old yet
+func (k *signingKeys) active() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	cutoff := time.Now().Add(-signingKeyActivation)
+	for _, key := range k.keys {
+		if key.createdAt.Before(cutoff) {
+			return key
+		}
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// published returns the keys whose tokens may still be valid: those created
+// since the active key, the active key, and any it replaced within the last
+// rotation period. The caller holds mu.
+func (k *signingKeys) published() []*signingKey {
+	if k.rotation == 0 {
+		return k.keys
+	}
+	cutoff := time.Now().Add(-signingKeyActivation)
+	for i, key := range k.keys {
+		// The first key old enough to sign is the active one; keys before it
+		// sign soon, and the one after it signed until it took over
+		if key.createdAt.Before(cutoff) {
+			if i+1 < len(k.keys) && time.Since(key.createdAt.Add(signingKeyActivation)) < k.rotation {
+				return k.keys[:i+2]
+			}
+			return k.keys[:i+1]
+		}
+	}
+	return k.keys
+}
+
+func (k *signingKeys) load(ctx context.Context) error {
+	records, err := k.db.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*signingKey, 0, len(records))
+	for _, record := range records {
+		parsed, err := x509.ParsePKCS8PrivateKey(record.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", record.ID, err)
+		}
+		private, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("signing key %s is not an RSA key", record.ID)
+		}
+		keys = append(keys, &signingKey{id: record.ID, private: private, createdAt: record.CreatedAt})
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// generate creates, stores and starts signing with a new key
+func (k *signingKeys) generate(ctx context.Context) error {
+	private, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	key := &signingKey{id: uuid.New().String(), private: private, createdAt: time.Now()}
+	err = k.db.SaveSigningKey(ctx, &models.SigningKey{
+		ID:         key.id,
+		PrivateKey: der,
+		CreatedAt:  key.createdAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = append([]*signingKey{key}, k.keys...)
+	k.mu.Unlock()
+	return nil
+}
+
+// sign signs the claims with the active key
+func (k *signingKeys) sign(typ string, claims jwt.Claims) (string, error) {
+	key := k.active()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+	token.Header["typ"] = typ
+	return token.SignedString(key.private)
+}
+
+// parse verifies a token signed by any known key and of the given type
+func (k *signingKeys) parse(tokenString, typ string, claims jwt.Claims, opts ...jwt.ParserOption) error {
+	opts = append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		k.mu.RLock()
+		defer k.mu.RUnlock()
+		for _, key := range k.published() {
+			if key.id == kid {
+				return &key.private.PublicKey, nil
+			}
+		}
+		return nil, errors.New("unknown signing key")
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	if token.Header["typ"] != typ {
+		return fmt.Errorf("unexpected token type %v", token.Header["typ"])
+	}
+	return nil
+}
+
+// jwk is a public key in JSON Web Key format
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// jwks returns the public half of every published key
+func (k *signingKeys) jwks() []jwk {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	published := k.published()
+	keys := make([]jwk, len(published))
+	for i, key := range published {
+		public := key.private.PublicKey
+		keys[i] = jwk{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodRS256.Alg(),
+			KeyID:     key.id,
+			Modulus:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	}
+	return keys
+}
@@ -30,9 +30,20 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({
   const checkAuth = useCallback(async () => {
     setLoading(true);
     try {
-      const resp = await fetch("http://localhost:8080/me", {
-        credentials: "include",
-      });
+      const me = () =>
+        fetch("http://localhost:8080/me", { credentials: "include" });
+      let resp = await me();
+      // With token sessions the access token expires long before the
+      // session; the refresh token cookie renews it
+      if (resp.status === 401) {
+        const refreshResp = await fetch(
+          "http://localhost:8080/session/refresh",
+          { method: "POST", credentials: "include" },
+        );
+        if (refreshResp.ok) {
+          resp = await me();
+        }
+      }
       if (resp.ok) {
         const userData = await resp.json();
         setIsAuthenticated(true);
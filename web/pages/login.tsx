@@ -1,32 +1,188 @@
-import React, { useState, useContext } from "react";
-import { bufferToBase64url, base64urlToBuffer } from "../utils/webauthn";
+import React, { useState, useContext, useEffect, useRef } from "react";
+import {
+  bufferToBase64url,
+  base64urlToBuffer,
+  describeError,
+  isRetryable,
+  readAPIError,
+} from "../utils/webauthn";
+import { csrfHeaders } from "../utils/csrf";
 import { AuthContext } from "../contexts/AuthContext";
 
+// Serialize an assertion so the server can parse it
+function assertionToJSON(assertion: PublicKeyCredential) {
+  const response = assertion.response as AuthenticatorAssertionResponse;
+  return {
+    id: assertion.id,
+    rawId: bufferToBase64url(assertion.rawId),
+    type: assertion.type,
+    response: {
+      clientDataJSON: bufferToBase64url(response.clientDataJSON),
+      authenticatorData: bufferToBase64url(response.authenticatorData),
+      signature: bufferToBase64url(response.signature),
+      userHandle: response.userHandle
+        ? bufferToBase64url(response.userHandle)
+        : undefined,
+    },
+  };
+}
+
+// Resume an OpenID Connect authorization that sent the user here to log in.
+// Only URLs under the issuer the backend advertises are followed.
+async function resumeAuthorization() {
+  const returnTo = new URLSearchParams(window.location.search).get(
+    "return_to",
+  );
+  if (!returnTo) {
+    return;
+  }
+
+  try {
+    const discovery = await fetch(
+      "http://localhost:8080/.well-known/openid-configuration",
+    );
+    if (!discovery.ok) {
+      return;
+    }
+    const issuer = new URL((await discovery.json()).issuer);
+    const target = new URL(returnTo);
+    const base = issuer.pathname.replace(/\/$/, "") + "/";
+    if (target.origin === issuer.origin && target.pathname.startsWith(base)) {
+      window.location.assign(target.href);
+    }
+  } catch (error) {
+    console.error("Could not resume authorization:", error);
+  }
+}
+
 const LoginPage: React.FC = () => {
   const [username, setUsername] = useState("");
   const [message, setMessage] = useState("");
   const { refreshAuth } = useContext(AuthContext);
+  const autofill = useRef<{
+    controller: AbortController;
+    ceremonyID: string;
+  } | null>(null);
+
+  // Abort a pending autofill request and drop its challenge on the server
+  const cancelAutofill = () => {
+    const pending = autofill.current;
+    if (!pending) {
+      return;
+    }
+    autofill.current = null;
+    pending.controller.abort();
+    csrfHeaders()
+      .then((headers) =>
+        fetch(
+          `http://localhost:8080/login/cancel?ceremonyID=${encodeURIComponent(pending.ceremonyID)}`,
+          { method: "POST", headers, credentials: "include" },
+        ),
+      )
+      .catch(() => {});
+  };
+
+  // Offer passkeys in the username field's autofill menu
+  useEffect(() => {
+    const startAutofill = async () => {
+      if (
+        !window.PublicKeyCredential ||
+        !PublicKeyCredential.isConditionalMediationAvailable ||
+        !(await PublicKeyCredential.isConditionalMediationAvailable())
+      ) {
+        return;
+      }
+
+      const beginResp = await fetch("http://localhost:8080/login/begin", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+          ...(await csrfHeaders()),
+        },
+        body: JSON.stringify({ mediation: "conditional" }),
+        credentials: "include",
+      });
+      if (!beginResp.ok) {
+        return;
+      }
+
+      const response = await beginResp.json();
+      const publicKeyOptions = response.publicKey.publicKey;
+      publicKeyOptions.challenge = base64urlToBuffer(
+        publicKeyOptions.challenge,
+      );
+
+      const controller = new AbortController();
+      autofill.current = { controller, ceremonyID: response.ceremonyID };
+
+      try {
+        const assertion = (await navigator.credentials.get({
+          mediation: "conditional",
+          publicKey: publicKeyOptions,
+          signal: controller.signal,
+        })) as PublicKeyCredential;
+        autofill.current = null;
+
+        const finishResp = await fetch(
+          `http://localhost:8080/login/finish?ceremonyID=${encodeURIComponent(response.ceremonyID)}`,
+          {
+            method: "POST",
+            headers: {
+              "Content-Type": "application/json",
+              ...(await csrfHeaders()),
+            },
+            body: JSON.stringify(assertionToJSON(assertion)),
+            credentials: "include",
+          },
+        );
+        if (!finishResp.ok) {
+          throw await readAPIError(finishResp);
+        }
+
+        setMessage("Login successful!");
+        refreshAuth();
+        resumeAuthorization();
+        // eslint-disable-next-line @typescript-eslint/no-explicit-any
+      } catch (error: any) {
+        if (error.name !== "AbortError") {
+          console.error("Detailed error:", error);
+          setMessage("Login failed: " + describeError(error));
+          // Offer passkeys again unless the user has to act first
+          if (isRetryable(error)) {
+            startAutofill();
+          }
+        }
+      }
+    };
+
+    startAutofill();
+    return () => cancelAutofill();
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [refreshAuth]);
 
   const handleLogin = async () => {
     setMessage("Starting login...");
+    cancelAutofill();
 
     try {
       // Step 1: Begin Login
       const beginResp = await fetch("http://localhost:8080/login/begin", {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+          "Content-Type": "application/json",
+          ...(await csrfHeaders()),
+        },
         body: JSON.stringify({ username }),
         credentials: "include",
       });
 
       if (!beginResp.ok) {
-        const error = await beginResp.text();
-        throw new Error(error);
+        throw await readAPIError(beginResp);
       }
 
       const response = await beginResp.json();
       const publicKeyOptions = response.publicKey.publicKey;
-      const userID = response.userID;
+      const ceremonyID = response.ceremonyID;
 
       // Convert options to proper format
       publicKeyOptions.challenge = base64urlToBuffer(
@@ -55,48 +211,31 @@ const LoginPage: React.FC = () => {
         signal: AbortSignal.timeout(60000),
       })) as PublicKeyCredential;
 
-      // Step 3: Prepare Data to Send to Server
-      const assertionData = {
-        id: assertion.id,
-        rawId: bufferToBase64url(assertion.rawId),
-        type: assertion.type,
-        response: {
-          clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
-          authenticatorData: bufferToBase64url(
-            (assertion.response as AuthenticatorAssertionResponse)
-              .authenticatorData,
-          ),
-          signature: bufferToBase64url(
-            (assertion.response as AuthenticatorAssertionResponse).signature,
-          ),
-          userHandle: bufferToBase64url(
-            (assertion.response as AuthenticatorAssertionResponse).userHandle!,
-          ),
-        },
-      };
-
-      // Step 4: Finish Login
+      // Step 3: Finish Login
       const finishResp = await fetch(
-        `http://localhost:8080/login/finish?userID=${encodeURIComponent(userID)}`,
+        `http://localhost:8080/login/finish?ceremonyID=${encodeURIComponent(ceremonyID)}`,
         {
           method: "POST",
-          headers: { "Content-Type": "application/json" },
-          body: JSON.stringify(assertionData),
+          headers: {
+            "Content-Type": "application/json",
+            ...(await csrfHeaders()),
+          },
+          body: JSON.stringify(assertionToJSON(assertion)),
           credentials: "include",
         },
       );
 
       if (!finishResp.ok) {
-        const error = await finishResp.text();
-        console.error("Detailed error:", error);
+        throw await readAPIError(finishResp);
       }
 
       setMessage("Login successful!");
       refreshAuth();
+      resumeAuthorization();
       // eslint-disable-next-line @typescript-eslint/no-explicit-any
     } catch (error: any) {
       console.error("Detailed error:", error);
-      setMessage("Login failed: " + error.message);
+      setMessage("Login failed: " + describeError(error));
     }
   };
 
@@ -108,6 +247,7 @@ const LoginPage: React.FC = () => {
         <input
           className="w-full border p-2"
           type="text"
+          autoComplete="username webauthn"
           value={username}
           onChange={(e) => setUsername(e.target.value)}
         />
@@ -1,10 +1,17 @@
 import React, { useState } from "react";
-import { bufferToBase64url, base64urlToBuffer } from "../utils/webauthn";
+import {
+  bufferToBase64url,
+  base64urlToBuffer,
+  describeError,
+  readAPIError,
+} from "../utils/webauthn";
+import { csrfHeaders } from "../utils/csrf";
 
 const RegisterPage: React.FC = () => {
   const [username, setUsername] = useState("");
   const [displayName, setDisplayName] = useState("");
   const [message, setMessage] = useState("");
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([]);
 
   const handleRegister = async () => {
     setMessage("Starting registration...");
@@ -13,24 +20,21 @@ const RegisterPage: React.FC = () => {
       // Step 1: Begin Registration
       const beginResp = await fetch("http://localhost:8080/register/begin", {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: {
+          "Content-Type": "application/json",
+          ...(await csrfHeaders()),
+        },
         body: JSON.stringify({ username, displayName }),
         credentials: "include",
       });
 
       if (!beginResp.ok) {
-        const errorText = await beginResp.text();
-        try {
-          const errorJson = JSON.parse(errorText);
-          throw new Error(errorJson.message || errorText);
-        } catch {
-          throw new Error(errorText);
-        }
+        throw await readAPIError(beginResp);
       }
 
       const response = await beginResp.json();
       const publicKeyOptions = response.publicKey.publicKey;
-      const userID = response.userID;
+      const ceremonyID = response.ceremonyID;
 
       // Convert options to proper format
       publicKeyOptions.user.id = base64urlToBuffer(publicKeyOptions.user.id);
@@ -67,11 +71,12 @@ const RegisterPage: React.FC = () => {
 
       // Step 4: Finish Registration
       const finishResp = await fetch(
-        `http://localhost:8080/register/finish?userID=${encodeURIComponent(userID)}`,
+        `http://localhost:8080/register/finish?ceremonyID=${encodeURIComponent(ceremonyID)}`,
         {
           method: "POST",
           headers: {
             "Content-Type": "application/json",
+            ...(await csrfHeaders()),
           },
           body: JSON.stringify(credentialData),
           credentials: "include",
@@ -79,20 +84,16 @@ const RegisterPage: React.FC = () => {
       );
 
       if (!finishResp.ok) {
-        const errorText = await finishResp.text();
-        try {
-          const errorJson = JSON.parse(errorText);
-          throw new Error(errorJson.message || errorText);
-        } catch {
-          throw new Error(errorText);
-        }
+        throw await readAPIError(finishResp);
       }
 
+      const result = await finishResp.json();
+      setRecoveryCodes(result.recoveryCodes || []);
       setMessage("Registration successful!");
       // eslint-disable-next-line @typescript-eslint/no-explicit-any
     } catch (error: any) {
       console.error(error);
-      setMessage("Registration failed: " + error.message);
+      setMessage("Registration failed: " + describeError(error));
     }
   };
 
@@ -124,6 +125,20 @@ const RegisterPage: React.FC = () => {
         Register
       </button>
       {message && <p className="mt-4">{message}</p>}
+      {recoveryCodes.length > 0 && (
+        <div className="mt-4">
+          <p className="font-bold">Recovery codes</p>
+          <p className="mb-2">
+            Store these somewhere safe. Each one lets you back in once if you
+            lose your passkeys, and they will not be shown again.
+          </p>
+          <ul className="font-mono">
+            {recoveryCodes.map((code) => (
+              <li key={code}>{code}</li>
+            ))}
+          </ul>
+        </div>
+      )}
     </div>
   );
 };
@@ -0,0 +1,26 @@
+let token: Promise<string> | null = null;
+
+// Fetch the double-submit token once per page load. The server sets the
+// matching cookie; sending the header is harmless in origin mode.
+function csrfToken(): Promise<string> {
+  if (!token) {
+    token = fetch("http://localhost:8080/csrf", { credentials: "include" })
+      .then((resp) => {
+        if (!resp.ok) {
+          throw new Error("Failed to get CSRF token");
+        }
+        return resp.json();
+      })
+      .then((data) => data.token as string)
+      .catch((err) => {
+        token = null;
+        throw err;
+      });
+  }
+  return token;
+}
+
+// Headers for state-changing requests to the API
+export async function csrfHeaders(): Promise<Record<string, string>> {
+  return { "X-CSRF-Token": await csrfToken() };
+}
@@ -18,3 +18,106 @@ export function base64urlToBuffer(baseurl64: string): ArrayBuffer {
   }
   return outputArray.buffer;
 }
+
+// Error envelope the API returns for every failed request
+export interface APIErrorBody {
+  code: string;
+  message: string;
+  requestID?: string;
+  // Only sent when the server runs with webauthn.debug
+  webauthn?: { type?: string; details: string; info?: string };
+}
+
+export class APIError extends Error {
+  readonly status: number;
+  readonly code: string;
+  readonly requestID?: string;
+  readonly webauthn?: APIErrorBody["webauthn"];
+  // Seconds to wait before trying again, for rate limited requests
+  readonly retryAfter?: number;
+
+  constructor(status: number, body: APIErrorBody, retryAfter?: number) {
+    super(body.message);
+    this.name = "APIError";
+    this.status = status;
+    this.code = body.code;
+    this.requestID = body.requestID;
+    this.webauthn = body.webauthn;
+    this.retryAfter = retryAfter;
+  }
+}
+
+// Read the error from a failed response. Proxies in front of the API may
+// answer in plain text, which still becomes an APIError.
+export async function readAPIError(resp: Response): Promise<APIError> {
+  const text = await resp.text();
+  let body: APIErrorBody = {
+    code: resp.status >= 500 ? "internal_error" : "invalid_request",
+    message: text || resp.statusText,
+  };
+  try {
+    const parsed = JSON.parse(text);
+    if (parsed?.error?.code) {
+      body = parsed.error;
+    }
+  } catch {
+    // Not JSON
+  }
+  const retryAfter = Number(resp.headers.get("Retry-After")) || undefined;
+  return new APIError(resp.status, body, retryAfter);
+}
+
+// Whether starting the ceremony over may succeed without the user changing
+// anything first
+export function isRetryable(error: unknown): boolean {
+  if (error instanceof APIError) {
+    return [
+      "ceremony_expired",
+      "login_failed",
+      "registration_failed",
+      "internal_error",
+    ].includes(error.code);
+  }
+  return false;
+}
+
+// A message for the user explaining what went wrong and what to do next
+export function describeError(error: unknown): string {
+  if (error instanceof APIError) {
+    switch (error.code) {
+      case "ceremony_expired":
+        return "The request expired. Please try again.";
+      case "login_failed":
+        return "That passkey was not accepted. Try again or use another passkey.";
+      case "registration_failed":
+        return "Your authenticator's response was not accepted. Please try again.";
+      case "authenticator_not_allowed":
+        return "This authenticator is not allowed here. Please use a different one.";
+      case "credential_suspended":
+        return "This passkey is suspended. Use another passkey or recover your account.";
+      case "credential_exists":
+        return "This authenticator is already registered. Log in with it instead.";
+      case "rate_limited":
+        return error.retryAfter
+          ? `Too many attempts. Try again in ${error.retryAfter} seconds.`
+          : "Too many attempts. Try again later.";
+      case "csrf_failed":
+        return "Your session is out of date. Reload the page and try again.";
+      case "internal_error":
+        return error.requestID
+          ? `Something went wrong on our side (request ${error.requestID}). Please try again later.`
+          : "Something went wrong on our side. Please try again later.";
+      default:
+        return error.message;
+    }
+  }
+  if (error instanceof DOMException) {
+    switch (error.name) {
+      case "NotAllowedError":
+        return "The request was cancelled or timed out.";
+      case "InvalidStateError":
+        return "This authenticator is already registered.";
+    }
+  }
+  return error instanceof Error ? error.message : String(error);
+}